@@ -35,6 +35,53 @@ func (f FuncRespHandler) Handle(resp *http.Response, ctx *ProxyCtx) *http.Respon
 	return f(resp, ctx)
 }
 
+// InterimRespHandler is an optional interface of RespHandlers that also want
+// to see the informational (1xx) responses, such as 103 Early Hints, that
+// precede the final response. HandleInterim may edit the header of resp and
+// returns whether resp is passed on to the client. 100 Continue is shown to
+// the handlers, but the proxy sends it whenever the request body is read.
+type InterimRespHandler interface {
+	HandleInterim(resp *http.Response, ctx *ProxyCtx) bool
+}
+
+// A wrapper that would convert a function to an InterimRespHandler interface type
+type FuncInterimRespHandler func(resp *http.Response, ctx *ProxyCtx) bool
+
+// FuncInterimRespHandler.HandleInterim(resp,ctx) <=> FuncInterimRespHandler(resp,ctx)
+func (f FuncInterimRespHandler) HandleInterim(resp *http.Response, ctx *ProxyCtx) bool {
+	return f(resp, ctx)
+}
+
+// WebsocketHandler filters the messages of the websockets the proxy relays.
+// It returns the messages to send in place of msg: none drops msg, and
+// messages with the opposite FromClient are sent back to where msg came from.
+type WebsocketHandler interface {
+	HandleMessage(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage
+}
+
+// A wrapper that would convert a function to a WebsocketHandler interface type
+type FuncWebsocketHandler func(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage
+
+// FuncWebsocketHandler.HandleMessage(msg,ctx) <=> FuncWebsocketHandler(msg,ctx)
+func (f FuncWebsocketHandler) HandleMessage(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage {
+	return f(msg, ctx)
+}
+
+// UpgradeHandler sees the connections the proxy streams once they switched
+// from HTTP to another protocol. It may replace s.FromClient and
+// s.FromServer with readers observing or rewriting what each side sends.
+type UpgradeHandler interface {
+	HandleUpgrade(s *UpgradeStream, ctx *ProxyCtx)
+}
+
+// A wrapper that would convert a function to a UpgradeHandler interface type
+type FuncUpgradeHandler func(s *UpgradeStream, ctx *ProxyCtx)
+
+// FuncUpgradeHandler.HandleUpgrade(s,ctx) <=> FuncUpgradeHandler(s,ctx)
+func (f FuncUpgradeHandler) HandleUpgrade(s *UpgradeStream, ctx *ProxyCtx) {
+	f(s, ctx)
+}
+
 // When a client send a CONNECT request to a host, the request is filtered through
 // all the HttpsHandlers the proxy has, and if one returns true, the connection is
 // sniffed using Man in the Middle attack.
@@ -0,0 +1,362 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialStore checks the credentials proxy clients authenticate with.
+type CredentialStore interface {
+	// Authenticate reports whether password is the password of user.
+	Authenticate(user, password string) bool
+}
+
+// PasswordStore is a CredentialStore that knows the passwords of its users,
+// which Digest authentication needs.
+type PasswordStore interface {
+	CredentialStore
+	// Password returns the password of user, ok is false for unknown users.
+	Password(user string) (password string, ok bool)
+}
+
+// StaticCredentials is a PasswordStore mapping user names to passwords.
+type StaticCredentials map[string]string
+
+func (c StaticCredentials) Authenticate(user, password string) bool {
+	expected, ok := c[user]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+func (c StaticCredentials) Password(user string) (string, bool) {
+	password, ok := c[user]
+	return password, ok
+}
+
+// CredentialsFunc adapts a function to a CredentialStore.
+type CredentialsFunc func(user, password string) bool
+
+func (f CredentialsFunc) Authenticate(user, password string) bool {
+	return f(user, password)
+}
+
+// Htpasswd is a CredentialStore backed by an Apache htpasswd file. It
+// understands bcrypt, apr1 (MD5) and {SHA} hashes. As it only has hashes
+// it cannot serve Digest authentication.
+type Htpasswd struct {
+	users map[string]string
+}
+
+// LoadHtpasswd reads htpasswd entries, one "user:hash" per line.
+func LoadHtpasswd(r io.Reader) (*Htpasswd, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := strings.IndexByte(entry, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("htpasswd line %d: missing user name", line)
+		}
+		users[entry[:i]] = entry[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &Htpasswd{users: users}, nil
+}
+
+// LoadHtpasswdFile reads the htpasswd file at path.
+func LoadHtpasswdFile(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadHtpasswd(f)
+}
+
+func (h *Htpasswd) Authenticate(user, password string) bool {
+	hashed, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	var computed string
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "$apr1$"):
+		salt := strings.TrimPrefix(hashed, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		// crypt(3) hashes are not supported
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+// apr1 is the Apache variant of the MD5-based crypt(3).
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	h := md5.New()
+	h.Write(pw)
+	io.WriteString(h, magic+salt)
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			io.WriteString(h, salt)
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := make([]byte, 0, 22)
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[i[0]])<<16|uint32(final[i[1]])<<8|uint32(final[i[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// DefaultDigestNonceTTL is how long a Digest nonce of ProxyAuth stays valid.
+const DefaultDigestNonceTTL = 5 * time.Minute
+
+// ProxyAuth requires proxy clients to authenticate, with Basic or, if its
+// Store is a PasswordStore, Digest authentication. Set it as
+// ProxyHttpServer.Auth to check plain requests as well as CONNECT requests,
+// the authenticated user is then available as ProxyCtx.User.
+type ProxyAuth struct {
+	Realm string
+	Store CredentialStore
+	// DisableBasic only offers Digest authentication, which does not send
+	// passwords in the clear.
+	DisableBasic bool
+	// NonceTTL is how long a Digest nonce stays valid, DefaultDigestNonceTTL
+	// if zero.
+	NonceTTL time.Duration
+
+	secretOnce sync.Once
+	secret     [32]byte
+}
+
+// NewProxyAuth returns a ProxyAuth checking credentials against store.
+func NewProxyAuth(realm string, store CredentialStore) *ProxyAuth {
+	return &ProxyAuth{Realm: realm, Store: store}
+}
+
+func (a *ProxyAuth) passwords() (PasswordStore, bool) {
+	store, ok := a.Store.(PasswordStore)
+	return store, ok
+}
+
+// authenticate returns the user r authenticated as. stale reports a Digest
+// response with a valid password but an expired nonce.
+func (a *ProxyAuth) authenticate(r *http.Request) (user string, stale bool, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	i := strings.IndexByte(auth, ' ')
+	if i < 0 {
+		return "", false, false
+	}
+	switch strings.ToLower(auth[:i]) {
+	case "basic":
+		if a.DisableBasic {
+			return "", false, false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[i+1:]))
+		if err != nil {
+			return "", false, false
+		}
+		credentials := string(decoded)
+		j := strings.IndexByte(credentials, ':')
+		if j < 0 {
+			return "", false, false
+		}
+		user = credentials[:j]
+		return user, false, a.Store.Authenticate(user, credentials[j+1:])
+	case "digest":
+		return a.checkDigest(r, auth)
+	}
+	return "", false, false
+}
+
+func (a *ProxyAuth) checkDigest(r *http.Request, auth string) (string, bool, bool) {
+	store, ok := a.passwords()
+	if !ok {
+		return "", false, false
+	}
+	_, params := parseChallenge(auth)
+	user := params["username"]
+	if params["realm"] != a.Realm || params["uri"] != r.RequestURI {
+		return user, false, false
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return user, false, false
+	}
+	password, ok := store.Password(user)
+	if !ok {
+		return user, false, false
+	}
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(user + ":" + a.Realm + ":" + password)
+	ha2 := h(r.Method + ":" + params["uri"])
+	nonce := params["nonce"]
+	var expected string
+	switch params["qop"] {
+	case "auth":
+		expected = h(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	case "":
+		expected = h(ha1 + ":" + nonce + ":" + ha2)
+	default:
+		return user, false, false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return user, false, false
+	}
+	valid, fresh := a.checkNonce(nonce)
+	if !valid {
+		return user, false, false
+	}
+	return user, !fresh, fresh
+}
+
+func (a *ProxyAuth) nonceTTL() time.Duration {
+	if a.NonceTTL > 0 {
+		return a.NonceTTL
+	}
+	return DefaultDigestNonceTTL
+}
+
+// nonce returns a Digest nonce carrying its creation time, signed so that
+// checkNonce can verify it without keeping state.
+func (a *ProxyAuth) nonce() string {
+	var created [8]byte
+	binary.BigEndian.PutUint64(created[:], uint64(time.Now().UnixNano()))
+	return hex.EncodeToString(created[:]) + hex.EncodeToString(a.sign(created[:]))
+}
+
+// checkNonce reports whether nonce was issued by a and whether it is still
+// fresh.
+func (a *ProxyAuth) checkNonce(nonce string) (valid, fresh bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size || !hmac.Equal(b[8:], a.sign(b[:8])) {
+		return false, false
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	return true, time.Since(created) < a.nonceTTL()
+}
+
+func (a *ProxyAuth) sign(b []byte) []byte {
+	a.secretOnce.Do(func() {
+		rand.Read(a.secret[:])
+	})
+	mac := hmac.New(sha256.New, a.secret[:])
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// challenge adds the Proxy-Authenticate challenges of a 407 response to h.
+func (a *ProxyAuth) challenge(h http.Header, stale bool) {
+	if _, ok := a.passwords(); ok {
+		digest := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=MD5, nonce=%q`, a.Realm, a.nonce())
+		if stale {
+			digest += ", stale=true"
+		}
+		h.Add("Proxy-Authenticate", digest)
+	}
+	if !a.DisableBasic {
+		h.Add("Proxy-Authenticate", fmt.Sprintf(`Basic realm=%q`, a.Realm))
+	}
+}
+
+// authResponse is the 407 response asking the client of r to authenticate.
+func (a *ProxyAuth) authResponse(r *http.Request, stale bool) *http.Response {
+	resp := NewResponse(r, ContentTypeText, http.StatusProxyAuthRequired, "Proxy Authentication Required")
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	a.challenge(resp.Header, stale)
+	return resp
+}
+
+// checkProxyAuth authenticates the client of r when the proxy requires
+// authentication, recording the user on ctx and hiding the credentials
+// from upstream servers. Otherwise it returns the 407 response to send.
+func (proxy *ProxyHttpServer) checkProxyAuth(r *http.Request, ctx *ProxyCtx) *http.Response {
+	if proxy.Auth == nil {
+		return nil
+	}
+	user, stale, ok := proxy.Auth.authenticate(r)
+	if !ok {
+		if user != "" && !stale {
+			ctx.Warnf("Authentication failed for user %q", user)
+		}
+		return proxy.Auth.authResponse(r, stale)
+	}
+	ctx.User = user
+	r.Header.Del("Proxy-Authorization")
+	return nil
+}
@@ -0,0 +1,150 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	orFatal("bcrypt", err, t)
+	h, err := LoadHtpasswd(strings.NewReader("# users\n" +
+		"apr:$apr1$xxxxxxxx$RKMOWWMKN4Ts9r6E5noqv0\n" +
+		"spaces:$apr1$s4lt$pFaSf46boiJALLn9AUPzO0\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"bc:" + string(bcrypted) + "\n"))
+	orFatal("load", err, t)
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"apr", "myPassword", true},
+		{"apr", "mypassword", false},
+		{"spaces", "p@ss w0rd", true},
+		{"sha", "secret", true},
+		{"sha", "Secret", false},
+		{"bc", "bcrypt-pass", true},
+		{"bc", "bcrypt", false},
+		{"nobody", "", false},
+	} {
+		if ok := h.Authenticate(c.user, c.password); ok != c.ok {
+			t.Errorf("Authenticate(%q, %q) = %v, expected %v", c.user, c.password, ok, c.ok)
+		}
+	}
+}
+
+func authProxy(t *testing.T, auth *ProxyAuth) (*ProxyHttpServer, *httptest.Server) {
+	proxy := NewProxyHttpServer()
+	proxy.Auth = auth
+	return proxy, httptest.NewServer(proxy)
+}
+
+func TestProxyAuthBasic(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Saw-Credentials", r.Header.Get("Proxy-Authorization"))
+	}))
+	defer upstream.Close()
+
+	proxy, srv := authProxy(t, NewProxyAuth("goproxy", StaticCredentials{"alice": "secret"}))
+	defer srv.Close()
+	proxy.OnResponse(UserIs("alice")).DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		resp.Header.Set("X-User", ctx.User)
+		return resp
+	})
+
+	for userinfo, expected := range map[string]int{
+		"":              http.StatusProxyAuthRequired,
+		"alice:wrong@":  http.StatusProxyAuthRequired,
+		"alice:secret@": http.StatusOK,
+	} {
+		proxyURL, err := url.Parse(strings.Replace(srv.URL, "://", "://"+userinfo, 1))
+		orFatal("parse proxy url", err, t)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(upstream.URL)
+		orFatal("get", err, t)
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("expected %d with %q, got %d", expected, userinfo, resp.StatusCode)
+			continue
+		}
+		if expected == http.StatusProxyAuthRequired {
+			challenges := strings.Join(resp.Header["Proxy-Authenticate"], "\n")
+			if !strings.Contains(challenges, `Basic realm="goproxy"`) || !strings.Contains(challenges, "Digest ") {
+				t.Errorf("expected Basic and Digest challenges, got %q", challenges)
+			}
+			continue
+		}
+		if resp.Header.Get("X-User") != "alice" {
+			t.Errorf("expected the user to be recorded on ProxyCtx, got %q", resp.Header.Get("X-User"))
+		}
+		if saw := resp.Header.Get("X-Saw-Credentials"); saw != "" {
+			t.Errorf("expected the credentials not to be forwarded upstream, got %q", saw)
+		}
+	}
+}
+
+// connectWithAuth sends a CONNECT for addr to the proxy at proxyAddr with the
+// given Proxy-Authorization and returns the response.
+func connectWithAuth(t *testing.T, proxyAddr, addr, authorization string) *http.Response {
+	conn, err := net.Dial("tcp", proxyAddr)
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if authorization != "" {
+		req += "Proxy-Authorization: " + authorization + "\r\n"
+	}
+	_, err = io.WriteString(conn, req+"\r\n")
+	orFatal("write CONNECT", err, t)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	orFatal("read CONNECT response", err, t)
+	return resp
+}
+
+func TestProxyAuthDigestConnect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	defer target.Close()
+	addr := target.Addr().String()
+
+	auth := NewProxyAuth("goproxy", StaticCredentials{"bob": "hunter2"})
+	auth.DisableBasic = true
+	_, srv := authProxy(t, auth)
+	defer srv.Close()
+	proxyAddr := srv.Listener.Addr().String()
+
+	resp := connectWithAuth(t, proxyAddr, addr, basicAuth("bob", "hunter2"))
+	if resp.StatusCode != http.StatusProxyAuthRequired || len(resp.Header["Proxy-Authenticate"]) != 1 {
+		t.Fatalf("expected Basic to be refused with a single Digest challenge, got %s %v", resp.Status, resp.Header)
+	}
+	_, params := parseChallenge(resp.Header.Get("Proxy-Authenticate"))
+
+	resp = connectWithAuth(t, proxyAddr, addr, digestAuth(params, "CONNECT", addr, "bob", "wrong"))
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expected a wrong password to be refused, got %s", resp.Status)
+	}
+	resp = connectWithAuth(t, proxyAddr, addr, digestAuth(params, "CONNECT", addr, "bob", "hunter2"))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the Digest response to be accepted, got %s", resp.Status)
+	}
+
+	forged := map[string]string{"realm": params["realm"], "qop": "auth", "nonce": "00" + params["nonce"][2:]}
+	resp = connectWithAuth(t, proxyAddr, addr, digestAuth(forged, "CONNECT", addr, "bob", "hunter2"))
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expected a forged nonce to be refused, got %s", resp.Status)
+	}
+
+	auth.NonceTTL = time.Nanosecond
+	resp = connectWithAuth(t, proxyAddr, addr, digestAuth(params, "CONNECT", addr, "bob", "hunter2"))
+	if resp.StatusCode != http.StatusProxyAuthRequired || !strings.Contains(resp.Header.Get("Proxy-Authenticate"), "stale=true") {
+		t.Errorf("expected an expired nonce to be reported stale, got %s %v", resp.Status, resp.Header)
+	}
+}
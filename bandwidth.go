@@ -0,0 +1,288 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bandwidthIdleTimeout is how long an unused bucket is kept, its
+	// counters disappear from BandwidthShaper.Stats afterwards.
+	bandwidthIdleTimeout = 5 * time.Minute
+	bandwidthSweepPeriod = time.Minute
+)
+
+// ShapingKey selects what traffic shares a bandwidth limit.
+type ShapingKey int
+
+const (
+	// ShapeByClient shares the limit between all traffic of a client IP.
+	ShapeByClient ShapingKey = iota
+	// ShapeByUser shares the limit between all traffic of a user
+	// authenticated with the proxy.
+	ShapeByUser
+	// ShapeByDestination shares the limit between all traffic to a host.
+	ShapeByDestination
+)
+
+func (k ShapingKey) String() string {
+	switch k {
+	case ShapeByClient:
+		return "client"
+	case ShapeByUser:
+		return "user"
+	case ShapeByDestination:
+		return "destination"
+	}
+	return "unknown"
+}
+
+// RateLimit is the rate of a token bucket.
+type RateLimit struct {
+	BytesPerSecond int64
+	// Burst is the number of bytes that may be sent at once after the
+	// bucket was idle. If zero, one second worth of traffic is allowed.
+	Burst int64
+}
+
+func (l RateLimit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.BytesPerSecond
+}
+
+// BandwidthShaper holds the token buckets shared by throttled connections.
+// Handlers choose the limits that apply to a request with ProxyCtx.Throttle,
+// typically through the ThrottleBy and ThrottleConnectBy actions:
+//
+//	video := regexp.MustCompile(`(^|\.)(youtube\.com|googlevideo\.com)(:\d+)?$`)
+//	limit := goproxy.RateLimit{BytesPerSecond: 256 << 10}
+//	proxy.OnRequest(goproxy.ReqHostMatches(video)).Do(goproxy.ThrottleBy(goproxy.ShapeByClient, limit))
+//	proxy.OnRequest(goproxy.ReqHostMatches(video)).HandleConnect(goproxy.ThrottleConnectBy(goproxy.ShapeByClient, limit))
+//
+// Requests and tunnels resolving to the same key share a bucket, the last
+// limit set for a key wins.
+type BandwidthShaper struct {
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	key   ShapingKey
+	value string
+}
+
+// BandwidthStats are the counters of a token bucket.
+type BandwidthStats struct {
+	Key   ShapingKey
+	Value string
+	Limit RateLimit
+	// Bytes counts the bytes that went through the bucket
+	Bytes int64
+	// Throttled is the total time connections waited for the bucket
+	Throttled time.Duration
+}
+
+// NewBandwidthShaper returns a BandwidthShaper without buckets.
+func NewBandwidthShaper() *BandwidthShaper {
+	return &BandwidthShaper{buckets: make(map[bucketKey]*tokenBucket)}
+}
+
+// Stats returns the counters of every bucket used recently, sorted by key.
+func (s *BandwidthShaper) Stats() []BandwidthStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]BandwidthStats, 0, len(s.buckets))
+	for key, b := range s.buckets {
+		b.mu.Lock()
+		limit := b.limit
+		b.mu.Unlock()
+		stats = append(stats, BandwidthStats{
+			Key:       key.key,
+			Value:     key.value,
+			Limit:     limit,
+			Bytes:     atomic.LoadInt64(&b.bytes),
+			Throttled: time.Duration(atomic.LoadInt64(&b.throttled)),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Key != stats[j].Key {
+			return stats[i].Key < stats[j].Key
+		}
+		return stats[i].Value < stats[j].Value
+	})
+	return stats
+}
+
+func (s *BandwidthShaper) bucket(key bucketKey, limit RateLimit) *tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > bandwidthSweepPeriod {
+		for k, b := range s.buckets {
+			if b.idleSince(now) > bandwidthIdleTimeout {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[bucketKey]*tokenBucket)
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.burst()), last: now}
+		s.buckets[key] = b
+	}
+	b.setLimit(limit)
+	return b
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+
+	bytes     int64
+	throttled int64
+}
+
+func (b *tokenBucket) setLimit(limit RateLimit) {
+	b.mu.Lock()
+	b.limit = limit
+	b.mu.Unlock()
+}
+
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last)
+}
+
+// take removes n tokens and returns how long the caller has to wait for the
+// bucket to be out of debt.
+func (b *tokenBucket) take(n int) time.Duration {
+	atomic.AddInt64(&b.bytes, int64(n))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	rate := float64(b.limit.BytesPerSecond)
+	if rate <= 0 {
+		b.last = now
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if burst := float64(b.limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-b.tokens / rate * float64(time.Second))
+	atomic.AddInt64(&b.throttled, int64(wait))
+	return wait
+}
+
+type throttle struct {
+	key   bucketKey
+	limit RateLimit
+}
+
+// Throttle limits the bandwidth of the current request, or of the tunnel when
+// called from a CONNECT handler, to limit shared by all traffic with the same
+// key. Requests of a MITM'd tunnel inherit its limits. It has no effect when
+// the proxy has no Bandwidth shaper or the key cannot be determined, for
+// example ShapeByUser when the client did not authenticate with the proxy.
+// Proxy-Authorization credentials that were not verified are not a user.
+func (ctx *ProxyCtx) Throttle(key ShapingKey, limit RateLimit) {
+	if ctx.Req == nil {
+		return
+	}
+	var value string
+	switch key {
+	case ShapeByClient:
+		value = stripPort(ctx.Req.RemoteAddr)
+	case ShapeByUser:
+		value = ctx.User
+	case ShapeByDestination:
+		value = ctx.Req.URL.Host
+		if value == "" {
+			value = ctx.Req.Host
+		}
+		value = stripPort(value)
+	}
+	if value == "" {
+		return
+	}
+	// never append in place, inherited limits share the backing array
+	ctx.throttles = append(ctx.throttles[:len(ctx.throttles):len(ctx.throttles)], throttle{bucketKey{key, value}, limit})
+}
+
+// ThrottleBy returns a ReqHandler applying ctx.Throttle(key, limit) to the
+// requests it handles.
+func ThrottleBy(key ShapingKey, limit RateLimit) FuncReqHandler {
+	return func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Throttle(key, limit)
+		return req, nil
+	}
+}
+
+// ThrottleConnectBy returns a HttpsHandler applying ctx.Throttle(key, limit)
+// to the CONNECT tunnels it handles, leaving the decision on the tunnel to
+// the following handlers.
+func ThrottleConnectBy(key ShapingKey, limit RateLimit) FuncHttpsHandler {
+	return func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		ctx.Throttle(key, limit)
+		return nil, host
+	}
+}
+
+// shapeReader returns r throttled by the limits set on ctx.
+func (ctx *ProxyCtx) shapeReader(r io.Reader) io.Reader {
+	shaper := ctx.proxy.Bandwidth
+	if len(ctx.throttles) == 0 || shaper == nil {
+		return r
+	}
+	sr := &shapedReader{r: r}
+	for _, t := range ctx.throttles {
+		sr.buckets = append(sr.buckets, shaper.bucket(t.key, t.limit))
+		if burst := int(t.limit.burst()); burst > 0 && (sr.max == 0 || burst < sr.max) {
+			sr.max = burst
+		}
+	}
+	return sr
+}
+
+type shapedReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+	// max keeps single reads within the smallest burst so that the
+	// traffic stays smooth
+	max int
+}
+
+func (sr *shapedReader) Read(p []byte) (int, error) {
+	if sr.max > 0 && len(p) > sr.max {
+		p = p[:sr.max]
+	}
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, b := range sr.buckets {
+			if d := b.take(n); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
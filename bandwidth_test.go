@@ -0,0 +1,69 @@
+package goproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShapeReaderLimitsRate(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.Bandwidth = NewBandwidthShaper()
+	req, err := http.NewRequest("GET", "http://example.com:8080/", nil)
+	orFatal("new request", err, t)
+	req.RemoteAddr = "10.0.0.1:1234"
+	ctx := &ProxyCtx{Req: req, proxy: proxy}
+	ctx.Throttle(ShapeByDestination, RateLimit{BytesPerSecond: 100 << 10, Burst: 10 << 10})
+
+	start := time.Now()
+	n, err := ioutil.ReadAll(ctx.shapeReader(bytes.NewReader(make([]byte, 50<<10))))
+	orFatal("read", err, t)
+	if len(n) != 50<<10 {
+		t.Fatalf("read %d bytes", len(n))
+	}
+	// the burst is free, the remaining 40KiB take 400ms
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("50KiB at 100KiB/s took only %v", elapsed)
+	}
+
+	stats := proxy.Bandwidth.Stats()
+	if len(stats) != 1 || stats[0].Key != ShapeByDestination || stats[0].Value != "example.com" || stats[0].Bytes != 50<<10 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats[0].Throttled == 0 {
+		t.Error("expected throttled time to be recorded")
+	}
+}
+
+func TestThrottleKeys(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.Bandwidth = NewBandwidthShaper()
+	req, err := http.NewRequest("CONNECT", "http://example.com:443", nil)
+	orFatal("new request", err, t)
+	req.RemoteAddr = "10.0.0.1:1234"
+	ctx := &ProxyCtx{Req: req, proxy: proxy, User: "user"}
+	limit := RateLimit{BytesPerSecond: 1}
+	ctx.Throttle(ShapeByClient, limit)
+	ctx.Throttle(ShapeByUser, limit)
+	ctx.Throttle(ShapeByDestination, limit)
+
+	want := []bucketKey{{ShapeByClient, "10.0.0.1"}, {ShapeByUser, "user"}, {ShapeByDestination, "example.com"}}
+	if len(ctx.throttles) != len(want) {
+		t.Fatalf("expected %d throttles, got %+v", len(want), ctx.throttles)
+	}
+	for i, k := range want {
+		if ctx.throttles[i].key != k {
+			t.Errorf("throttle %d: expected %+v, got %+v", i, k, ctx.throttles[i].key)
+		}
+	}
+
+	// credentials nobody verified must not pick the bucket
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz") // user:pass
+	anonymous := &ProxyCtx{Req: req, proxy: proxy}
+	anonymous.Throttle(ShapeByUser, limit)
+	if len(anonymous.throttles) != 0 {
+		t.Errorf("expected no user throttle without authentication, got %+v", anonymous.throttles)
+	}
+}
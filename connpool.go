@@ -0,0 +1,403 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// DefaultPoolIdleTimeout is how long ConnPool keeps an unused upstream connection.
+	DefaultPoolIdleTimeout = 30 * time.Second
+	// DefaultPoolMaxIdleConnsPerHost is the number of idle connections ConnPool keeps per key.
+	DefaultPoolMaxIdleConnsPerHost = 4
+)
+
+// ConnPool shares upstream uTLS connections between MITM sessions, so a new
+// CONNECT to a host the proxy already talks to does not pay for a handshake.
+//
+// The pool keeps two things. Connections handed back with Put, typically the
+// connection dialed to probe the upstream ALPN, wait in an idle list keyed by
+// address, negotiated ALPN and fingerprint until a dial with the same key takes
+// them or IdleTimeout expires. RoundTripper returns transports shared by every
+// tunnel using the same fingerprint: http/1.1 connections are kept alive by an
+// http.Transport and h2 connections are multiplexed by an http2.Transport, both
+// taking their connections from the idle list before dialing.
+type ConnPool struct {
+	// IdleTimeout is how long an unused connection is kept open.
+	// If zero, DefaultPoolIdleTimeout is used.
+	IdleTimeout time.Duration
+	// MaxIdleConnsPerHost limits idle connections kept per address, ALPN and
+	// fingerprint. If zero, DefaultPoolMaxIdleConnsPerHost is used.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the http/1.1 connections a shared transport opens
+	// to a single host. h2 requests are multiplexed and need no limit. Zero
+	// means no limit.
+	MaxConnsPerHost int
+	// Dial makes the TCP connections of pooled transports, either to the
+	// upstream server or to the upstream proxy. If nil, the pool of a
+	// ProxyHttpServer dials through its Resolver, IPPolicy and Dial timeout,
+	// and net.Dial is used otherwise.
+	Dial func(network, addr string) (net.Conn, error)
+
+	mu         sync.Mutex
+	idle       map[poolKey][]*idleConn
+	transports map[transportKey]http.RoundTripper
+	h2         []*http2.Transport
+	janitor    *time.Ticker
+	stop       chan struct{}
+}
+
+type poolKey struct {
+	addr, alpn, fingerprint string
+}
+
+type transportKey struct {
+	fingerprint, alpn, proxyURL string
+	insecure                    bool
+	owner                       *ProxyHttpServer
+}
+
+type idleConn struct {
+	conn  *utls.UConn
+	timer *time.Timer
+}
+
+// NewConnPool returns an empty ConnPool using the default limits.
+func NewConnPool() *ConnPool {
+	return &ConnPool{
+		idle:       make(map[poolKey][]*idleConn),
+		transports: make(map[transportKey]http.RoundTripper),
+	}
+}
+
+func (p *ConnPool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return DefaultPoolIdleTimeout
+}
+
+func (p *ConnPool) maxIdle() int {
+	if p.MaxIdleConnsPerHost > 0 {
+		return p.MaxIdleConnsPerHost
+	}
+	return DefaultPoolMaxIdleConnsPerHost
+}
+
+// Put hands an established upstream connection to the pool. addr is the
+// address it was dialed to. The connection is closed if the pool already holds
+// enough idle connections for its address, ALPN and fingerprint.
+func (p *ConnPool) Put(conn *utls.UConn, addr string) {
+	key := poolKey{addr, conn.ConnectionState().NegotiatedProtocol, helloKey(conn.ClientHelloID)}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[poolKey][]*idleConn)
+	}
+	if len(p.idle[key]) >= p.maxIdle() {
+		conn.Close()
+		return
+	}
+	ic := &idleConn{conn: conn}
+	ic.timer = time.AfterFunc(p.idleTimeout(), func() {
+		if p.remove(key, ic) {
+			conn.Close()
+		}
+	})
+	p.idle[key] = append(p.idle[key], ic)
+}
+
+// Get takes an idle connection to addr made with id, whose negotiated ALPN is
+// one of alpn, preferring them in order. An empty alpn matches connections
+// without ALPN. It returns nil when no usable connection is pooled.
+func (p *ConnPool) Get(addr string, id utls.ClientHelloID, alpn ...string) *utls.UConn {
+	if len(alpn) == 0 {
+		alpn = []string{""}
+	}
+	for _, proto := range alpn {
+		key := poolKey{addr, proto, helloKey(id)}
+		for {
+			ic := p.pop(key)
+			if ic == nil {
+				break
+			}
+			if proto == http2.NextProtoTLS || connAlive(ic.conn) {
+				return ic.conn
+			}
+			ic.conn.Close()
+		}
+	}
+	return nil
+}
+
+func (p *ConnPool) pop(key poolKey) *idleConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	ic := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns[:len(conns)-1]
+	}
+	ic.timer.Stop()
+	return ic
+}
+
+func (p *ConnPool) remove(key poolKey, ic *idleConn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	for i, c := range conns {
+		if c == ic {
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = conns
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// connAlive reports whether an idle http/1.1 connection was not closed by the
+// server while it sat in the pool. It must not be used on h2 connections, the
+// server speaks first there and the read would eat its SETTINGS frame.
+func connAlive(conn *utls.UConn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	// either an error or unsolicited data, both make the connection unusable
+	return false
+}
+
+// CloseIdleConnections closes every pooled connection that is not in use.
+func (p *ConnPool) CloseIdleConnections() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[poolKey][]*idleConn)
+	transports := make([]http.RoundTripper, 0, len(p.transports))
+	for _, rt := range p.transports {
+		transports = append(transports, rt)
+	}
+	p.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, ic := range conns {
+			ic.timer.Stop()
+			ic.conn.Close()
+		}
+	}
+	for _, rt := range transports {
+		if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// Close closes the idle connections, stops the goroutine reaping idle h2
+// connections and drops the shared transports. The pool can still be used
+// afterwards, transports are then created anew.
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	if p.janitor != nil {
+		p.janitor.Stop()
+		close(p.stop)
+		p.janitor, p.stop = nil, nil
+	}
+	transports := p.transports
+	p.transports, p.h2 = nil, nil
+	p.mu.Unlock()
+
+	p.CloseIdleConnections()
+	for _, rt := range transports {
+		if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// RoundTripper returns the transport shared by all tunnels that use the
+// fingerprint named name (see NewUTLSRoundTripper) for upstream requests
+// speaking alpn, which is either "h2" or "http/1.1". cfg provides the client
+// side settings such as certificate verification; its ServerName and
+// certificates are ignored, the SNI is taken from each request. The first
+// cfg seen for a fingerprint, ALPN and upstream proxy wins.
+func (p *ConnPool) RoundTripper(name string, cfg *utls.Config, proxyURL *url.URL, alpn string) (http.RoundTripper, error) {
+	clientHelloID, ok := clientHelloIDMap[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("no uTLS Client Hello ID named %q", name)
+	}
+	if clientHelloID == nil {
+		return httpRoundTripper, nil
+	}
+	return p.roundTripper(clientHelloID, cfg, proxyURL, alpn, nil)
+}
+
+// roundTripper is RoundTripper for clientHelloID. The transports of an owner
+// dial like the proxy does when Dial is nil, and fall back to the
+// fingerprints its Fingerprints offer for the host, see dialFingerprints.
+func (p *ConnPool) roundTripper(clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyURL *url.URL, alpn string, owner *ProxyHttpServer) (http.RoundTripper, error) {
+	if alpn != http2.NextProtoTLS {
+		alpn = "http/1.1"
+	}
+	key := transportKey{fingerprint: helloKey(*clientHelloID), alpn: alpn, owner: owner}
+	if proxyURL != nil {
+		key.proxyURL = proxyURL.String()
+	}
+	if cfg != nil {
+		key.insecure = cfg.InsecureSkipVerify
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rt, ok := p.transports[key]; ok {
+		return rt, nil
+	}
+
+	var clientCfg *utls.Config
+	if cfg != nil {
+		clientCfg = cfg.Clone()
+	} else {
+		clientCfg = &utls.Config{}
+	}
+	clientCfg.ServerName = ""
+	clientCfg.Certificates = nil
+	clientCfg.NextProtos = []string{alpn}
+
+	var selector *FingerprintSelector
+	dialTCP := p.Dial
+	if owner != nil {
+		selector = owner.Fingerprints
+		if dialTCP == nil {
+			dialTCP = owner.dialTimeout
+		}
+	}
+	var forward proxy.Dialer = proxy.Direct
+	if dialTCP != nil {
+		forward = dialerFunc(dialTCP)
+	}
+	proxyDialer, err := makeProxyDialer(proxyURL, clientCfg, clientHelloID, forward)
+	if err != nil {
+		return nil, err
+	}
+	dial := p.dialer(clientCfg, clientHelloID, proxyDialer, alpn, selector)
+
+	httpRT := httpRoundTripper.Clone()
+	httpRT.Proxy = http.ProxyURL(proxyURL)
+
+	rt := &pooledRoundTripper{httpRT: httpRT}
+	switch alpn {
+	case http2.NextProtoTLS:
+		tr := &http2.Transport{
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(network, addr)
+			},
+		}
+		p.h2 = append(p.h2, tr)
+		p.startJanitorLocked()
+		rt.rt = tr
+	default:
+		tr := httpRoundTripper.Clone()
+		tr.DialTLS = dial
+		tr.IdleConnTimeout = p.idleTimeout()
+		tr.MaxIdleConnsPerHost = p.maxIdle()
+		tr.MaxConnsPerHost = p.MaxConnsPerHost
+		rt.rt = tr
+	}
+	if p.transports == nil {
+		p.transports = make(map[transportKey]http.RoundTripper)
+	}
+	p.transports[key] = rt
+	return rt, nil
+}
+
+// dialer returns a DialTLS callback that prefers pooled connections and only
+// accepts connections that negotiated alpn.
+func (p *ConnPool) dialer(cfg *utls.Config, clientHelloID *utls.ClientHelloID, proxyDialer proxy.Dialer, alpn string, selector *FingerprintSelector) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		accepted := []string{alpn}
+		if alpn == "http/1.1" {
+			accepted = append(accepted, "")
+		}
+		// the first candidate is the fingerprint that last worked for addr
+		candidates := fingerprintCandidates(selector, addr, alpn, *clientHelloID)
+		if conn := p.Get(addr, candidates[0], accepted...); conn != nil {
+			return conn, nil
+		}
+		return dialFingerprints(network, addr, cfg, candidates, proxyDialer, selector, alpn, func(uconn *utls.UConn) error {
+			if proto := uconn.ConnectionState().NegotiatedProtocol; proto != alpn && !(proto == "" && alpn == "http/1.1") {
+				return fmt.Errorf("unexpected ALPN %q from %s, wanted %q", proto, addr, alpn)
+			}
+			return nil
+		})
+	}
+}
+
+// startJanitorLocked periodically closes h2 connections without active
+// streams, http2.Transport has no idle timeout of its own.
+func (p *ConnPool) startJanitorLocked() {
+	if p.janitor != nil {
+		return
+	}
+	ticker, stop := time.NewTicker(p.idleTimeout()), make(chan struct{})
+	p.janitor, p.stop = ticker, stop
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			p.mu.Lock()
+			h2 := append([]*http2.Transport(nil), p.h2...)
+			p.mu.Unlock()
+			for _, tr := range h2 {
+				tr.CloseIdleConnections()
+			}
+		}
+	}()
+}
+
+// pooledRoundTripper sends https requests through a shared uTLS transport and
+// plain http requests through an ordinary http.Transport.
+type pooledRoundTripper struct {
+	rt     http.RoundTripper
+	httpRT *http.Transport
+}
+
+func (rt *pooledRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Scheme {
+	case "http":
+		return rt.httpRT.RoundTrip(req)
+	case "https":
+		return rt.rt.RoundTrip(req)
+	}
+	return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+}
+
+func (rt *pooledRoundTripper) CloseIdleConnections() {
+	rt.httpRT.CloseIdleConnections()
+	if c, ok := rt.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,90 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func dialTestUConn(t *testing.T, addr string) *tls.UConn {
+	conn, err := net.Dial("tcp", addr)
+	orFatal("dial", err, t)
+	uconn := tls.UClient(conn, &tls.Config{InsecureSkipVerify: true}, tls.HelloGolang)
+	orFatal("handshake", uconn.Handshake(), t)
+	return uconn
+}
+
+func TestConnPoolReuse(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	pool := NewConnPool()
+	conn := dialTestUConn(t, addr)
+	pool.Put(conn, addr)
+
+	if got := pool.Get(addr, tls.HelloChrome_Auto, ""); got != nil {
+		t.Fatal("connection handed out for another fingerprint")
+	}
+	if got := pool.Get(addr, tls.HelloGolang, "h2"); got != nil {
+		t.Fatal("connection handed out for another ALPN")
+	}
+	if got := pool.Get(addr, tls.HelloGolang, "h2", ""); got != conn {
+		t.Fatal("expected pooled connection to be reused")
+	}
+	if got := pool.Get(addr, tls.HelloGolang, ""); got != nil {
+		t.Fatal("connection handed out twice")
+	}
+	conn.Close()
+}
+
+func TestConnPoolIdleTimeout(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	pool := NewConnPool()
+	pool.IdleTimeout = 10 * time.Millisecond
+	pool.Put(dialTestUConn(t, addr), addr)
+	time.Sleep(50 * time.Millisecond)
+	if got := pool.Get(addr, tls.HelloGolang, ""); got != nil {
+		t.Fatal("expired connection was reused")
+	}
+}
+
+func TestConnPoolDropsClosedConn(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	addr := srv.Listener.Addr().String()
+
+	pool := NewConnPool()
+	pool.Put(dialTestUConn(t, addr), addr)
+	srv.CloseClientConnections()
+	srv.Close()
+	time.Sleep(10 * time.Millisecond)
+	if got := pool.Get(addr, tls.HelloGolang, ""); got != nil {
+		t.Fatal("connection closed by the server was reused")
+	}
+}
+
+func TestConnPoolCloseStopsJanitor(t *testing.T) {
+	pool := NewConnPool()
+	_, err := pool.RoundTripper("hellochrome_auto", &tls.Config{}, nil, "h2")
+	orFatal("h2 round tripper", err, t)
+	if pool.janitor == nil {
+		t.Fatal("expected janitor for h2 transport")
+	}
+	pool.Close()
+	if pool.janitor != nil || len(pool.transports) != 0 {
+		t.Fatal("Close left the janitor or transports behind")
+	}
+	_, err = pool.RoundTripper("hellochrome_auto", &tls.Config{}, nil, "h2")
+	orFatal("h2 round tripper after Close", err, t)
+	if pool.janitor == nil {
+		t.Fatal("janitor not restarted after Close")
+	}
+	pool.Close()
+}
@@ -1,8 +1,12 @@
 package goproxy
 
 import (
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sync/atomic"
 
 	tls "github.com/refraction-networking/utls"
 )
@@ -25,6 +29,107 @@ type ProxyCtx struct {
 	certStore       CertStorage
 	proxy           *ProxyHttpServer
 	ConnectionState *tls.ConnectionState
+	// ResolvedIPs are the addresses the proxy Resolver returned for the
+	// last upstream connection used by this context
+	ResolvedIPs []net.IP
+	// RoundTripDetails describes the upstream connection of the last round
+	// trip made for this context, nil until the request was sent
+	RoundTripDetails *RoundTripDetails
+	// User is the name the client authenticated as when the proxy requires
+	// authentication, see ProxyHttpServer.Auth
+	User string
+	// Tunnel is the MITM'd CONNECT tunnel the request was read from, nil
+	// for requests sent to the proxy directly
+	Tunnel *TunnelCtx
+	// TunnelRequest numbers the requests read from Tunnel, starting at 1
+	TunnelRequest int64
+	// StreamResponse, set by a handler, has the response body flushed to
+	// the client as it arrives, as for the proxy StreamingContentTypes
+	StreamResponse bool
+	throttles      []throttle
+	// upgradeDone is called once the protocol the request switched to
+	// ended
+	upgradeDone []func()
+	// values holds the state of the proxy components following the
+	// request, by component
+	values map[interface{}]interface{}
+}
+
+// TunnelCtx describes a CONNECT tunnel the proxy MITMs. It is the parent of
+// the ProxyCtx of every request read from the tunnel.
+type TunnelCtx struct {
+	// ID is the Session of the CONNECT context
+	ID int64
+	// ClientAddr is the address of the client that sent the CONNECT
+	ClientAddr string
+	// Host is the host:port the client asked to CONNECT to
+	Host string
+	// SNI and ALPN are the server name the client sent and the protocol
+	// negotiated with it, both empty for plain HTTP tunnels
+	SNI  string
+	ALPN string
+	// User is the name the client authenticated as, if any
+	User string
+	// Ctx is the context of the CONNECT request
+	Ctx *ProxyCtx
+
+	requests int64
+}
+
+func newTunnelCtx(ctx *ProxyCtx, sni, alpn string) *TunnelCtx {
+	return &TunnelCtx{
+		ID:         ctx.Session,
+		ClientAddr: ctx.Req.RemoteAddr,
+		Host:       ctx.Req.Host,
+		SNI:        sni,
+		ALPN:       alpn,
+		User:       ctx.User,
+		Ctx:        ctx,
+	}
+}
+
+// Requests returns the number of requests read from the tunnel so far.
+func (t *TunnelCtx) Requests() int64 {
+	return atomic.LoadInt64(&t.requests)
+}
+
+// newCtx returns the context of req, read from the tunnel. It inherits the
+// UserData, user and bandwidth limits of the CONNECT context.
+func (t *TunnelCtx) newCtx(req *http.Request) *ProxyCtx {
+	parent := t.Ctx
+	return &ProxyCtx{
+		Req:           req,
+		Session:       atomic.AddInt64(&parent.proxy.sess, 1),
+		proxy:         parent.proxy,
+		UserData:      parent.UserData,
+		User:          parent.User,
+		Tunnel:        t,
+		TunnelRequest: atomic.AddInt64(&t.requests, 1),
+		throttles:     parent.throttles,
+	}
+}
+
+func (ctx *ProxyCtx) value(key interface{}) interface{} {
+	return ctx.values[key]
+}
+
+func (ctx *ProxyCtx) setValue(key, value interface{}) {
+	if ctx.values == nil {
+		ctx.values = make(map[interface{}]interface{})
+	}
+	ctx.values[key] = value
+}
+
+// afterUpgrade has f called once the protocol the request of ctx switched
+// the connection to ended.
+func (ctx *ProxyCtx) afterUpgrade(f func()) {
+	ctx.upgradeDone = append(ctx.upgradeDone, f)
+}
+
+func (ctx *ProxyCtx) upgradeEnded() {
+	for _, f := range ctx.upgradeDone {
+		f()
+	}
 }
 
 type RoundTripper interface {
@@ -43,12 +148,22 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
 	if ctx.RoundTripper != nil {
-		return ctx.RoundTripper.RoundTrip(req, ctx)
+		return ctx.recordRoundTrip(req, nil, func(req *http.Request) (*http.Response, error) {
+			return ctx.RoundTripper.RoundTrip(req, ctx)
+		})
 	}
-	return ctx.proxy.Tr.RoundTrip(req)
+	var proxyURL *url.URL
+	if ctx.proxy.Tr.Proxy != nil {
+		proxyURL, _ = ctx.proxy.Tr.Proxy(req)
+	}
+	return ctx.recordRoundTrip(req, proxyURL, ctx.proxy.Tr.RoundTrip)
 }
 
 func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
+	if ctx.Tunnel != nil {
+		// correlate requests with their tunnel
+		msg = fmt.Sprintf("[%03d#%d] ", ctx.Tunnel.ID&0xFF, ctx.TunnelRequest) + msg
+	}
 	ctx.proxy.Logger.Printf("[%03d] "+msg+"\n", append([]interface{}{ctx.Session & 0xFF}, argv...)...)
 }
 
@@ -0,0 +1,78 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// RoundTripDetails describes the upstream connection a request was sent
+// over. It is filled on ProxyCtx by every round trip the proxy makes, plain
+// or MITM'd, so that response handlers and loggers can look at it.
+type RoundTripDetails struct {
+	// TCPAddr is the remote address of the connection, the upstream proxy
+	// when one was used. It is nil when the connection is not TCP.
+	TCPAddr *net.TCPAddr
+	// ProxyURL is the upstream proxy the request went through, nil when
+	// it was sent directly.
+	ProxyURL *url.URL
+	// Reused reports whether the connection had carried an earlier
+	// request, WasIdle and IdleTime whether and how long it was idle
+	// before this one.
+	Reused   bool
+	WasIdle  bool
+	IdleTime time.Duration
+	// TLSVersion, CipherSuite and NegotiatedProtocol describe the TLS
+	// session with the server, they are zero for plain HTTP.
+	TLSVersion         uint16
+	CipherSuite        uint16
+	NegotiatedProtocol string
+	// Error is the error the round trip failed with, if any.
+	Error error
+}
+
+// IsProxy reports whether the request went through an upstream proxy.
+func (d *RoundTripDetails) IsProxy() bool {
+	return d.ProxyURL != nil
+}
+
+// gotConn records the connection the transport picked for the request.
+func (d *RoundTripDetails) gotConn(info httptrace.GotConnInfo) {
+	d.Reused = info.Reused
+	d.WasIdle = info.WasIdle
+	d.IdleTime = info.IdleTime
+	if info.Conn == nil {
+		return
+	}
+	d.TCPAddr, _ = info.Conn.RemoteAddr().(*net.TCPAddr)
+	switch conn := info.Conn.(type) {
+	case interface{ ConnectionState() tls.ConnectionState }:
+		state := conn.ConnectionState()
+		d.TLSVersion, d.CipherSuite, d.NegotiatedProtocol = state.Version, state.CipherSuite, state.NegotiatedProtocol
+	case interface{ ConnectionState() utls.ConnectionState }:
+		state := conn.ConnectionState()
+		d.TLSVersion, d.CipherSuite, d.NegotiatedProtocol = state.Version, state.CipherSuite, state.NegotiatedProtocol
+	}
+}
+
+// recordRoundTrip sends req with roundTrip, filling ctx.RoundTripDetails
+// and ctx.ResolvedIPs from the connection the transport used. proxyURL is the upstream proxy
+// roundTrip sends req through, if known.
+func (ctx *ProxyCtx) recordRoundTrip(req *http.Request, proxyURL *url.URL, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	details := &RoundTripDetails{ProxyURL: proxyURL}
+	ctx.RoundTripDetails = details
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		details.gotConn(info)
+		if ips := resolvedIPs(info.Conn); ips != nil {
+			ctx.ResolvedIPs = ips
+		}
+	}}
+	resp, err := roundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	details.Error = err
+	return resp, err
+}
@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// detailsProxy returns a client of a proxy MITM'ing every CONNECT and the
+// details of each round trip the proxy made.
+func detailsProxy(t *testing.T) (*http.Client, <-chan *RoundTripDetails, func()) {
+	details := make(chan *RoundTripDetails, 10)
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		details <- ctx.RoundTripDetails
+		return resp
+	})
+	srv := httptest.NewServer(proxy)
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	return client, details, srv.Close
+}
+
+func getAndDiscard(t *testing.T, client *http.Client, u string) {
+	resp, err := client.Get(u)
+	orFatal("get", err, t)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func TestRoundTripDetailsPlain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	client, details, done := detailsProxy(t)
+	defer done()
+
+	getAndDiscard(t, client, upstream.URL)
+	getAndDiscard(t, client, upstream.URL)
+	first, second := <-details, <-details
+	if first == nil || second == nil {
+		t.Fatal("expected round trip details")
+	}
+	if first.TCPAddr == nil || first.TCPAddr.String() != upstream.Listener.Addr().String() {
+		t.Errorf("unexpected remote address %v", first.TCPAddr)
+	}
+	if first.Reused || !second.Reused {
+		t.Errorf("expected the second request to reuse the connection, got %v and %v", first.Reused, second.Reused)
+	}
+	if first.IsProxy() || first.TLSVersion != 0 || first.Error != nil {
+		t.Errorf("unexpected details %+v", first)
+	}
+}
+
+func TestRoundTripDetailsMitm(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	client, details, done := detailsProxy(t)
+	defer done()
+
+	getAndDiscard(t, client, upstream.URL)
+	d := <-details
+	if d == nil {
+		t.Fatal("expected round trip details")
+	}
+	if d.TCPAddr == nil || d.TCPAddr.String() != upstream.Listener.Addr().String() {
+		t.Errorf("unexpected remote address %v", d.TCPAddr)
+	}
+	if d.TLSVersion < tls.VersionTLS12 || d.CipherSuite == 0 {
+		t.Errorf("expected the TLS session to be described, got %+v", d)
+	}
+}
@@ -97,15 +97,16 @@ func ReqHostIs(hosts ...string) ReqConditionFunc {
 	}
 }
 
-var localHostIpv4 = regexp.MustCompile(`127\.0\.0\.\d+`)
-
-// IsLocalHost checks whether the destination host is explicitly local host
-// (buggy, there can be IPv6 addresses it doesn't catch)
+// IsLocalHost checks whether the destination host is explicitly local host, that is "localhost" or
+// a loopback IPv4 or IPv6 literal, with or without a port. Use DstIsPrivate to also catch host names
+// resolving to loopback addresses.
 var IsLocalHost ReqConditionFunc = func(req *http.Request, ctx *ProxyCtx) bool {
-	return req.URL.Host == "::1" ||
-		req.URL.Host == "0:0:0:0:0:0:0:1" ||
-		localHostIpv4.MatchString(req.URL.Host) ||
-		req.URL.Host == "localhost"
+	host := stripPort(req.URL.Host)
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 // UrlMatches returns a ReqCondition testing whether the destination URL
@@ -124,11 +125,14 @@ func DstHostIs(host string) ReqConditionFunc {
 	}
 }
 
-// SrcIpIs returns a ReqCondition testing whether the source IP of the request is one of the given strings
+// SrcIpIs returns a ReqCondition testing whether the source IP of the request is one of the given strings.
+// IPv6 addresses match whatever their notation.
 func SrcIpIs(ips ...string) ReqCondition {
 	return ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
+		src := stripPort(req.RemoteAddr)
+		srcIP := net.ParseIP(src)
 		for _, ip := range ips {
-			if strings.HasPrefix(req.RemoteAddr, ip+":") {
+			if src == ip || (srcIP != nil && srcIP.Equal(net.ParseIP(ip))) {
 				return true
 			}
 		}
@@ -136,6 +140,44 @@ func SrcIpIs(ips ...string) ReqCondition {
 	})
 }
 
+// UserIs returns a ReqCondition testing whether the client authenticated as one of the given users,
+// see ProxyHttpServer.Auth. It holds for requests of MITM'd tunnels of those users too.
+func UserIs(users ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		if ctx.User == "" {
+			return false
+		}
+		for _, user := range users {
+			if ctx.User == user {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DstIPIn returns a ReqCondition testing whether the destination host of the request resolves to an
+// address in one of the given CIDR networks. It panics if a network is invalid. Conditions only see the
+// addresses at the time they run, set ProxyHttpServer.IPPolicy to check the address actually dialed.
+func DstIPIn(cidrs ...string) ReqConditionFunc {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, ip := range ctx.lookupDst(req) {
+			if containsIP(nets, ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DstIsPrivate is a ReqCondition testing whether the destination host of the request resolves to one
+// of the PrivateNetworks
+var DstIsPrivate = DstIPIn(PrivateNetworks...)
+
 // Not returns a ReqCondition negating the given ReqCondition
 func Not(r ReqCondition) ReqConditionFunc {
 	return func(req *http.Request, ctx *ProxyCtx) bool {
@@ -267,8 +309,12 @@ func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http
 }
 
 // ProxyConds.Do will register the RespHandler on the proxy, h.Handle(resp,ctx) will be called on every
-// request that matches the conditions aggregated in pcond.
+// request that matches the conditions aggregated in pcond. If h is also an InterimRespHandler, it
+// is registered for the interim responses as well.
 func (pcond *ProxyConds) Do(h RespHandler) {
+	if ih, ok := h.(InterimRespHandler); ok {
+		pcond.DoInterim(ih)
+	}
 	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers,
 		FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 			for _, cond := range pcond.reqConds {
@@ -285,6 +331,30 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 		}))
 }
 
+// ProxyConds.DoInterimFunc is equivalent to proxy.OnResponse().DoInterim(FuncInterimRespHandler(f))
+func (pcond *ProxyConds) DoInterimFunc(f func(resp *http.Response, ctx *ProxyCtx) bool) {
+	pcond.DoInterim(FuncInterimRespHandler(f))
+}
+
+// ProxyConds.DoInterim will register the InterimRespHandler on the proxy, h.HandleInterim(resp,ctx)
+// will be called on every informational response that matches the conditions aggregated in pcond.
+func (pcond *ProxyConds) DoInterim(h InterimRespHandler) {
+	pcond.proxy.interimHandlers = append(pcond.proxy.interimHandlers,
+		FuncInterimRespHandler(func(resp *http.Response, ctx *ProxyCtx) bool {
+			for _, cond := range pcond.reqConds {
+				if !cond.HandleReq(ctx.Req, ctx) {
+					return true
+				}
+			}
+			for _, cond := range pcond.respCond {
+				if !cond.HandleResp(resp, ctx) {
+					return true
+				}
+			}
+			return h.HandleInterim(resp, ctx)
+		}))
+}
+
 // OnResponse is used when adding a response-filter to the HTTP proxy, usual pattern is
 //	proxy.OnResponse(cond1,cond2).Do(handler) // handler.Handle(resp,ctx) will be used
 //				// if cond1.HandleResp(resp) && cond2.HandleResp(resp)
@@ -292,6 +362,79 @@ func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
 	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
 }
 
+// WebsocketConds aggregates the ReqConditions a websocket handshake request
+// must meet for a WebsocketHandler to see the messages of the websocket.
+type WebsocketConds struct {
+	proxy    *ProxyHttpServer
+	reqConds []ReqCondition
+}
+
+// OnWebsocketMessage is used when adding a filter for websocket messages, the conditions are
+// checked against the handshake request, ctx.Req:
+//	proxy.OnWebsocketMessage(goproxy.ReqHostIs("chat.example.com:443")).DoFunc(
+//		func(msg *goproxy.WebsocketMessage, ctx *goproxy.ProxyCtx) []*goproxy.WebsocketMessage {
+//			log.Printf("client %v: %s", msg.FromClient, msg.Data)
+//			return []*goproxy.WebsocketMessage{msg}
+//		})
+func (proxy *ProxyHttpServer) OnWebsocketMessage(conds ...ReqCondition) *WebsocketConds {
+	return &WebsocketConds{proxy, conds}
+}
+
+// WebsocketConds.DoFunc is equivalent to proxy.OnWebsocketMessage().Do(FuncWebsocketHandler(f))
+func (wcond *WebsocketConds) DoFunc(f func(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage) {
+	wcond.Do(FuncWebsocketHandler(f))
+}
+
+// WebsocketConds.Do will register the WebsocketHandler on the proxy, h.HandleMessage(msg,ctx) will be
+// called on every message of the websockets whose handshake matches the conditions aggregated in wcond.
+func (wcond *WebsocketConds) Do(h WebsocketHandler) {
+	wcond.proxy.websocketHandlers = append(wcond.proxy.websocketHandlers,
+		FuncWebsocketHandler(func(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage {
+			for _, cond := range wcond.reqConds {
+				if !cond.HandleReq(ctx.Req, ctx) {
+					return []*WebsocketMessage{msg}
+				}
+			}
+			return h.HandleMessage(msg, ctx)
+		}))
+}
+
+// UpgradeConds aggregates the ReqConditions a request switching protocols
+// must meet for an UpgradeHandler to see the stream it switched to.
+type UpgradeConds struct {
+	proxy    *ProxyHttpServer
+	reqConds []ReqCondition
+}
+
+// OnUpgrade is used when adding a handler for connections switched to another protocol, the
+// conditions are checked against the request that switched, ctx.Req:
+//	proxy.OnUpgrade(goproxy.ReqHostIs("h2c.example.com:80")).DoFunc(
+//		func(s *goproxy.UpgradeStream, ctx *goproxy.ProxyCtx) {
+//			s.FromServer = io.TeeReader(s.FromServer, logFile)
+//		})
+func (proxy *ProxyHttpServer) OnUpgrade(conds ...ReqCondition) *UpgradeConds {
+	return &UpgradeConds{proxy, conds}
+}
+
+// UpgradeConds.DoFunc is equivalent to proxy.OnUpgrade().Do(FuncUpgradeHandler(f))
+func (ucond *UpgradeConds) DoFunc(f func(s *UpgradeStream, ctx *ProxyCtx)) {
+	ucond.Do(FuncUpgradeHandler(f))
+}
+
+// UpgradeConds.Do will register the UpgradeHandler on the proxy, h.HandleUpgrade(s,ctx) will be
+// called on every stream switched to by a request matching the conditions aggregated in ucond.
+func (ucond *UpgradeConds) Do(h UpgradeHandler) {
+	ucond.proxy.upgradeHandlers = append(ucond.proxy.upgradeHandlers,
+		FuncUpgradeHandler(func(s *UpgradeStream, ctx *ProxyCtx) {
+			for _, cond := range ucond.reqConds {
+				if !cond.HandleReq(ctx.Req, ctx) {
+					return
+				}
+			}
+			h.HandleUpgrade(s, ctx)
+		}))
+}
+
 // AlwaysMitm is a HttpsHandler that always eavesdrop https connections, for example to
 // eavesdrop all https connections to www.google.com, we can use
 //	proxy.OnRequest(goproxy.ReqHostIs("www.google.com")).HandleConnect(goproxy.AlwaysMitm)
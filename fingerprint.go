@@ -0,0 +1,277 @@
+package goproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// DefaultFingerprintTTL is how long a FingerprintSelector remembers the
+// ClientHelloID that worked for a host.
+const DefaultFingerprintTTL = 24 * time.Hour
+
+// DefaultFingerprints is a fallback order for NewFingerprintSelector.
+var DefaultFingerprints = []tls.ClientHelloID{
+	tls.HelloChrome_Auto,
+	tls.HelloFirefox_Auto,
+	tls.HelloIOS_Auto,
+}
+
+// FingerprintSelector picks the ClientHelloID used for MITM upstream
+// handshakes. Some servers reject particular presets, so when a handshake
+// fails or negotiates an ALPN that was not offered, the next fingerprint of
+// Fallbacks is tried. The one that worked is remembered per host and ALPN
+// offer until TTL expires, unless an operator pinned a choice with Pin.
+type FingerprintSelector struct {
+	// Fallbacks is the ordered list of fingerprints tried after the
+	// remembered and the preferred one.
+	Fallbacks []tls.ClientHelloID
+	// TTL is how long a learned fingerprint is kept. If zero,
+	// DefaultFingerprintTTL is used.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	choices map[fingerprintKey]*FingerprintChoice
+}
+
+type fingerprintKey struct {
+	host, alpn string
+}
+
+// FingerprintChoice is the fingerprint remembered for a host.
+type FingerprintChoice struct {
+	Host string
+	// ALPN is the first protocol offered to the host, a server may need a
+	// different fingerprint depending on whether h2 is offered.
+	ALPN          string
+	ClientHelloID tls.ClientHelloID
+	// Pinned choices are set by an operator, they never expire and are
+	// the only fingerprint tried for the host.
+	Pinned  bool
+	Expires time.Time
+}
+
+// NewFingerprintSelector returns a FingerprintSelector trying fallbacks in order.
+func NewFingerprintSelector(fallbacks ...tls.ClientHelloID) *FingerprintSelector {
+	return &FingerprintSelector{
+		Fallbacks: fallbacks,
+		choices:   make(map[fingerprintKey]*FingerprintChoice),
+	}
+}
+
+func (s *FingerprintSelector) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return DefaultFingerprintTTL
+}
+
+// Candidates returns the fingerprints to try, in order, for a handshake with
+// host offering alpn first: the remembered one, then preferred, then the
+// fallbacks.
+func (s *FingerprintSelector) Candidates(host, alpn string, preferred tls.ClientHelloID) []tls.ClientHelloID {
+	var candidates []tls.ClientHelloID
+	add := func(id tls.ClientHelloID) {
+		for _, c := range candidates {
+			if c == id {
+				return
+			}
+		}
+		candidates = append(candidates, id)
+	}
+	if choice, ok := s.Lookup(host, alpn); ok {
+		if choice.Pinned {
+			return []tls.ClientHelloID{choice.ClientHelloID}
+		}
+		add(choice.ClientHelloID)
+	}
+	add(preferred)
+	for _, id := range s.Fallbacks {
+		add(id)
+	}
+	return candidates
+}
+
+// Learn remembers that id worked for host. Pinned choices are left alone.
+func (s *FingerprintSelector) Learn(host, alpn string, id tls.ClientHelloID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fingerprintKey{host, alpn}
+	if choice, ok := s.choices[key]; ok && choice.Pinned {
+		return
+	}
+	s.setLocked(key, &FingerprintChoice{Host: host, ALPN: alpn, ClientHelloID: id, Expires: time.Now().Add(s.ttl())})
+}
+
+// Pin makes id the only fingerprint used for host when offering alpn first.
+func (s *FingerprintSelector) Pin(host, alpn string, id tls.ClientHelloID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLocked(fingerprintKey{host, alpn}, &FingerprintChoice{Host: host, ALPN: alpn, ClientHelloID: id, Pinned: true})
+}
+
+func (s *FingerprintSelector) setLocked(key fingerprintKey, choice *FingerprintChoice) {
+	if s.choices == nil {
+		s.choices = make(map[fingerprintKey]*FingerprintChoice)
+	}
+	s.choices[key] = choice
+}
+
+// Forget drops the learned or pinned fingerprint for host.
+func (s *FingerprintSelector) Forget(host, alpn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.choices, fingerprintKey{host, alpn})
+}
+
+// Lookup returns the fingerprint remembered for host, if it did not expire.
+func (s *FingerprintSelector) Lookup(host, alpn string) (FingerprintChoice, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fingerprintKey{host, alpn}
+	choice, ok := s.choices[key]
+	if !ok {
+		return FingerprintChoice{}, false
+	}
+	if !choice.Pinned && time.Now().After(choice.Expires) {
+		delete(s.choices, key)
+		return FingerprintChoice{}, false
+	}
+	return *choice, true
+}
+
+// Choices returns every remembered fingerprint, sorted by host.
+func (s *FingerprintSelector) Choices() []FingerprintChoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	choices := make([]FingerprintChoice, 0, len(s.choices))
+	for key, choice := range s.choices {
+		if !choice.Pinned && now.After(choice.Expires) {
+			delete(s.choices, key)
+			continue
+		}
+		choices = append(choices, *choice)
+	}
+	sort.Slice(choices, func(i, j int) bool {
+		if choices[i].Host != choices[j].Host {
+			return choices[i].Host < choices[j].Host
+		}
+		return choices[i].ALPN < choices[j].ALPN
+	})
+	return choices
+}
+
+// fingerprintCandidates is selector.Candidates, or just preferred without a
+// selector.
+func fingerprintCandidates(selector *FingerprintSelector, host, alpn string, preferred tls.ClientHelloID) []tls.ClientHelloID {
+	if selector == nil {
+		return []tls.ClientHelloID{preferred}
+	}
+	return selector.Candidates(host, alpn, preferred)
+}
+
+// uClient returns a client for conn handshaking with id, and the function
+// running its handshake. Parrots and randomized hellos may bring their own
+// ALPN extension, usually with h2 in it, so unless cfg.NextProtos is empty
+// their ALPN and ALPS extensions are cut down to the protocols in
+// cfg.NextProtos; a server then never negotiates a protocol the caller cannot
+// speak. Once the handshake is done the connection reports id as its
+// ClientHelloID.
+func uClient(conn net.Conn, cfg *tls.Config, id tls.ClientHelloID) (*tls.UConn, func() error) {
+	randomized := false
+	switch id.Client {
+	case tls.HelloGolang.Client, tls.HelloCustom.Client:
+		uconn := tls.UClient(conn, cfg, id)
+		return uconn, uconn.Handshake
+	case tls.HelloRandomized.Client, tls.HelloRandomizedALPN.Client, tls.HelloRandomizedNoALPN.Client:
+		randomized = true
+	}
+	spec, err := tls.UTLSIdToSpec(id)
+	if err != nil {
+		uconn := tls.UClient(conn, cfg, id)
+		return uconn, uconn.Handshake
+	}
+	if randomized {
+		shareHybridGroups(spec.Extensions)
+	}
+	if len(cfg.NextProtos) > 0 {
+		spec.Extensions = offerProtos(spec.Extensions, cfg.NextProtos)
+	}
+	uconn := tls.UClient(conn, cfg, tls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return uconn, func() error { return err }
+	}
+	return uconn, func() error {
+		if err := uconn.Handshake(); err != nil {
+			return err
+		}
+		uconn.ClientHelloID = id
+		return nil
+	}
+}
+
+// shareHybridGroups adds a key share for X25519MLKEM768 when exts offer the
+// group without one, as randomized hellos sometimes do. A server preferring
+// the group would ask for its share with a HelloRetryRequest, which uTLS
+// cannot answer for hybrid groups.
+func shareHybridGroups(exts []tls.TLSExtension) {
+	offered := false
+	var shares *tls.KeyShareExtension
+	for _, ext := range exts {
+		switch e := ext.(type) {
+		case *tls.SupportedCurvesExtension:
+			for _, curve := range e.Curves {
+				offered = offered || curve == tls.X25519MLKEM768
+			}
+		case *tls.KeyShareExtension:
+			shares = e
+		}
+	}
+	if !offered || shares == nil {
+		return
+	}
+	for _, share := range shares.KeyShares {
+		if share.Group == tls.X25519MLKEM768 {
+			return
+		}
+	}
+	shares.KeyShares = append([]tls.KeyShare{{Group: tls.X25519MLKEM768}}, shares.KeyShares...)
+}
+
+// offerProtos returns exts with the ALPN and ALPS extensions limited to
+// protos, dropping those left without a protocol.
+func offerProtos(exts []tls.TLSExtension, protos []string) []tls.TLSExtension {
+	filter := func(offered []string) []string {
+		var kept []string
+		for _, proto := range offered {
+			for _, p := range protos {
+				if p == proto {
+					kept = append(kept, proto)
+					break
+				}
+			}
+		}
+		return kept
+	}
+	kept := exts[:0:0]
+	for _, ext := range exts {
+		switch e := ext.(type) {
+		case *tls.ALPNExtension:
+			ext = &tls.ALPNExtension{AlpnProtocols: append([]string(nil), protos...)}
+		case *tls.ApplicationSettingsExtension:
+			if e.SupportedProtocols = filter(e.SupportedProtocols); len(e.SupportedProtocols) == 0 {
+				continue
+			}
+		case *tls.ApplicationSettingsExtensionNew:
+			if e.SupportedProtocols = filter(e.SupportedProtocols); len(e.SupportedProtocols) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, ext)
+	}
+	return kept
+}
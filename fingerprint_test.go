@@ -0,0 +1,113 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestFingerprintSelectorOrder(t *testing.T) {
+	s := NewFingerprintSelector(tls.HelloChrome_Auto, tls.HelloFirefox_Auto)
+	got := s.Candidates("example.com:443", "h2", tls.HelloChrome_Auto)
+	want := []tls.ClientHelloID{tls.HelloChrome_Auto, tls.HelloFirefox_Auto}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	s.Learn("example.com:443", "h2", tls.HelloFirefox_Auto)
+	got = s.Candidates("example.com:443", "h2", tls.HelloChrome_Auto)
+	want = []tls.ClientHelloID{tls.HelloFirefox_Auto, tls.HelloChrome_Auto}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected learned fingerprint first %v, got %v", want, got)
+	}
+	if _, ok := s.Lookup("example.com:443", "http/1.1"); ok {
+		t.Error("fingerprint learned for h2 used for http/1.1")
+	}
+}
+
+func TestFingerprintSelectorPinAndExpiry(t *testing.T) {
+	s := NewFingerprintSelector(tls.HelloChrome_Auto, tls.HelloFirefox_Auto)
+	s.TTL = time.Millisecond
+
+	s.Learn("a:443", "h2", tls.HelloFirefox_Auto)
+	s.Pin("b:443", "h2", tls.HelloIOS_Auto)
+	s.Learn("b:443", "h2", tls.HelloFirefox_Auto)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := s.Lookup("a:443", "h2"); ok {
+		t.Error("learned fingerprint did not expire")
+	}
+	got := s.Candidates("b:443", "h2", tls.HelloChrome_Auto)
+	if want := []tls.ClientHelloID{tls.HelloIOS_Auto}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only the pinned fingerprint, got %v", got)
+	}
+	if choices := s.Choices(); len(choices) != 1 || !choices[0].Pinned {
+		t.Errorf("unexpected choices %+v", choices)
+	}
+	s.Forget("b:443", "h2")
+	if len(s.Choices()) != 0 {
+		t.Error("Forget kept the pinned fingerprint")
+	}
+}
+
+func TestParrotsOfferOnlyNextProtos(t *testing.T) {
+	srv := newProtoServer(true)
+	defer srv.Close()
+
+	for _, id := range DefaultFingerprints {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		orFatal("dial", err, t)
+		uconn, handshake := uClient(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "example.com", NextProtos: []string{"http/1.1"}}, id)
+		orFatal("handshake "+helloKey(id), handshake(), t)
+		// the server only speaks h2, it negotiates nothing without an offer
+		if proto := uconn.ConnectionState().NegotiatedProtocol; proto != "" {
+			t.Errorf("%s negotiated %q", helloKey(id), proto)
+		}
+		if uconn.ClientHelloID != id {
+			t.Errorf("expected ClientHelloID %s, got %s", helloKey(id), helloKey(uconn.ClientHelloID))
+		}
+		uconn.Close()
+	}
+}
+
+func TestRandomizedHellosShareHybridGroups(t *testing.T) {
+	srv := newProtoServer(false)
+	defer srv.Close()
+
+	// about one in thirty randomized hellos offered X25519MLKEM768 without
+	// a key share, which crypto/tls servers asked for with a retry
+	for i := 0; i < 200; i++ {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		orFatal("dial", err, t)
+		uconn, handshake := uClient(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"}, tls.HelloRandomizedNoALPN)
+		orFatal("handshake", handshake(), t)
+		uconn.Close()
+	}
+}
+
+func TestConnPoolFallsBackToFingerprints(t *testing.T) {
+	srv := newProtoServer(true)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	bogus := tls.ClientHelloID{Client: "Bogus", Version: "1"}
+	selector := NewFingerprintSelector(tls.HelloChrome_Auto)
+	owner := &ProxyHttpServer{Fingerprints: selector}
+	rt, err := NewConnPool().roundTripper(&bogus, &tls.Config{InsecureSkipVerify: true}, nil, "http/1.1", owner)
+	orFatal("round tripper", err, t)
+	resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+	orFatal("get", err, t)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "HTTP/1.1" {
+		t.Errorf("expected HTTP/1.1, got %s", b)
+	}
+	if choice, ok := selector.Lookup(addr, "http/1.1"); !ok || choice.ClientHelloID != tls.HelloChrome_Auto {
+		t.Errorf("expected the fallback to be learned, got %+v", choice)
+	}
+}
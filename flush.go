@@ -0,0 +1,112 @@
+package goproxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flushLatency returns how long the body of resp may stay buffered on its
+// way to the client, negative to flush it after every write and zero to
+// leave flushing to the buffers, see FlushInterval.
+func (proxy *ProxyHttpServer) flushLatency(resp *http.Response, ctx *ProxyCtx) time.Duration {
+	if ctx.StreamResponse || resp.ContentLength < 0 || proxy.isStreamingType(resp.Header.Get("Content-Type")) {
+		return -1
+	}
+	return proxy.FlushInterval
+}
+
+func (proxy *ProxyHttpServer) isStreamingType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range proxy.StreamingContentTypes {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyResponseBody copies body to w, flushing w with the given latency when
+// it is an http.Flusher. The header is flushed right away for streaming
+// bodies, so that clients see the response before its first event.
+func copyResponseBody(w http.ResponseWriter, body io.Reader, latency time.Duration) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || latency == 0 {
+		return io.Copy(w, body)
+	}
+	if latency < 0 {
+		flusher.Flush()
+	}
+	fw := newFlushWriter(w, func() error {
+		flusher.Flush()
+		return nil
+	}, latency)
+	defer fw.stop()
+	return io.Copy(fw, body)
+}
+
+// flushWriter writes to w and flushes it with flush after every write when
+// latency is negative, or at most latency after a write when positive.
+// Writes and flushes are serialized, the delayed flushes run on a timer.
+type flushWriter struct {
+	w       io.Writer
+	flush   func() error
+	latency time.Duration
+
+	mu sync.Mutex
+	t  *time.Timer
+	// pending is set while a delayed flush is due
+	pending bool
+}
+
+func newFlushWriter(w io.Writer, flush func() error, latency time.Duration) *flushWriter {
+	return &flushWriter{w: w, flush: flush, latency: latency}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	switch {
+	case fw.latency < 0:
+		err = fw.flush()
+	case fw.latency > 0 && !fw.pending:
+		fw.pending = true
+		if fw.t == nil {
+			fw.t = time.AfterFunc(fw.latency, fw.delayedFlush)
+		} else {
+			fw.t.Reset(fw.latency)
+		}
+	}
+	return n, err
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.pending {
+		return
+	}
+	fw.pending = false
+	fw.flush()
+}
+
+// stop cancels a delayed flush, what remains buffered is the caller's to
+// flush.
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	if fw.t != nil {
+		fw.t.Stop()
+	}
+}
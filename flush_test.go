@@ -0,0 +1,99 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// eventServer sends a server-sent event and holds the second one back
+// until release is closed, giving up if the first one does not get through.
+func eventServer(release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			io.WriteString(w, "data: two\n\n")
+		case <-time.After(5 * time.Second):
+			io.WriteString(w, "data: stuck\n\n")
+		}
+	}))
+}
+
+func expectEvents(t *testing.T, r *bufio.Reader, release chan struct{}) {
+	line, err := r.ReadString('\n')
+	orFatal("read first event", err, t)
+	if line != "data: one\n" {
+		t.Fatalf("unexpected event %q", line)
+	}
+	close(release)
+	r.ReadString('\n')
+	line, err = r.ReadString('\n')
+	orFatal("read second event", err, t)
+	if line != "data: two\n" {
+		t.Errorf("unexpected event %q", line)
+	}
+}
+
+func TestEventStreamFlushed(t *testing.T) {
+	release := make(chan struct{})
+	upstream := eventServer(release)
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(upstream.URL)
+	orFatal("get", err, t)
+	defer resp.Body.Close()
+	expectEvents(t, bufio.NewReader(resp.Body), release)
+}
+
+func TestEventStreamFlushedThroughHTTPMitm(t *testing.T) {
+	release := make(chan struct{})
+	upstream := eventServer(release)
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	conn, r, done := httpMitmTunnel(t, addr)
+	defer done()
+	req, err := http.NewRequest("GET", "http://"+addr+"/", nil)
+	orFatal("new request", err, t)
+	orFatal("write request", req.Write(conn), t)
+	resp, err := http.ReadResponse(r, req)
+	orFatal("read response", err, t)
+	defer resp.Body.Close()
+	expectEvents(t, bufio.NewReader(resp.Body), release)
+}
+
+func TestFlushLatency(t *testing.T) {
+	proxy := NewProxyHttpServer()
+	proxy.FlushInterval = time.Second
+	ctx := &ProxyCtx{proxy: proxy}
+	for _, c := range []struct {
+		contentType string
+		length      int64
+		stream      bool
+		expected    time.Duration
+	}{
+		{"text/html", 10, false, time.Second},
+		{"text/event-stream; charset=utf-8", 10, false, -1},
+		{"application/grpc-web+proto", 10, false, -1},
+		{"text/html", -1, false, -1},
+		{"application/json", 10, true, -1},
+	} {
+		ctx.StreamResponse = c.stream
+		resp := &http.Response{Header: http.Header{"Content-Type": {c.contentType}}, ContentLength: c.length}
+		if got := proxy.flushLatency(resp, ctx); got != c.expected {
+			t.Errorf("%+v: expected latency %v, got %v", c, c.expected, got)
+		}
+	}
+}
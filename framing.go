@@ -0,0 +1,139 @@
+package goproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bodyAllowed reports whether a response with the given status to a request
+// with the given method may carry a body, see RFC 7230 section 3.3.
+func bodyAllowed(method string, status int) bool {
+	if method == "HEAD" {
+		return false
+	}
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// writeHijackedResponse writes resp, the final response to req, to a client
+// connection taken over from net/http, reading its body from body.
+//
+// The response keeps its Content-Length when knownLength says that
+// resp.ContentLength still describes body. Otherwise it is sent chunked,
+// with the trailers of resp, to HTTP/1.1 clients, and delimited by closing
+// the connection for HTTP/1.0 clients. Responses to HEAD requests and 1xx,
+// 204 and 304 responses are written without a body.
+//
+// The header is written right away, the body is buffered and flushed as
+// latency says, see flushLatency.
+//
+// keepAlive is whether the connection should carry another request. It
+// returns whether it still can, which is not the case when the body had to
+// be delimited by closing the connection.
+func writeHijackedResponse(w io.Writer, req *http.Request, resp *http.Response, body io.Reader, knownLength, keepAlive bool, latency time.Duration) (bool, error) {
+	proto := "HTTP/1.1"
+	if !req.ProtoAtLeast(1, 1) {
+		proto = "HTTP/1.0"
+	}
+	withBody := bodyAllowed(req.Method, resp.StatusCode)
+	length := int64(-1)
+	if knownLength {
+		length = resp.ContentLength
+	}
+	chunked := withBody && length < 0 && proto == "HTTP/1.1"
+	if withBody && length < 0 && !chunked {
+		keepAlive = false
+	}
+
+	header := resp.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Del("Transfer-Encoding")
+	header.Del("Trailer")
+	switch {
+	case withBody && length >= 0:
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+	case withBody:
+		header.Del("Content-Length")
+	case resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent:
+		header.Del("Content-Length")
+	case length >= 0:
+		// HEAD and 304 responses announce the length of the body a GET
+		// would have returned
+		header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	if chunked {
+		header.Set("Transfer-Encoding", "chunked")
+		for name := range resp.Trailer {
+			header.Add("Trailer", name)
+		}
+	}
+	if keepAlive {
+		header.Del("Connection")
+	} else {
+		header.Set("Connection", "close")
+	}
+
+	text := resp.Status
+	statusCode := strconv.Itoa(resp.StatusCode) + " "
+	if strings.HasPrefix(text, statusCode) {
+		text = text[len(statusCode):]
+	}
+	if text == "" {
+		text = http.StatusText(resp.StatusCode)
+	}
+	bw := bufio.NewWriter(w)
+	io.WriteString(bw, proto+" "+statusCode+text+"\r\n")
+	header.Write(bw)
+	io.WriteString(bw, "\r\n")
+	if err := bw.Flush(); err != nil {
+		return false, err
+	}
+
+	if !withBody {
+		return keepAlive, nil
+	}
+	out := io.Writer(bw)
+	var cw io.WriteCloser
+	if chunked {
+		cw = newChunkedWriter(bw)
+		out = cw
+	}
+	fw := newFlushWriter(out, bw.Flush, latency)
+	defer fw.stop()
+	switch {
+	case length >= 0:
+		n, err := io.CopyN(fw, body, length)
+		if err == io.EOF {
+			err = fmt.Errorf("response body ended after %d of %d bytes", n, length)
+		}
+		if err == nil {
+			fw.stop()
+			err = bw.Flush()
+		}
+		return keepAlive && err == nil, err
+	case !chunked:
+		_, err := io.Copy(fw, body)
+		if err == nil {
+			fw.stop()
+			err = bw.Flush()
+		}
+		return false, err
+	}
+	if _, err := io.Copy(fw, body); err != nil {
+		return false, err
+	}
+	fw.stop()
+	if err := cw.Close(); err != nil {
+		return false, err
+	}
+	// resp.Trailer is only complete once its body was read
+	resp.Trailer.Write(bw)
+	io.WriteString(bw, "\r\n")
+	return keepAlive, bw.Flush()
+}
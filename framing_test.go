@@ -0,0 +1,84 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWriteHijackedResponse(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		method      string
+		proto       int // minor version of the request
+		status      int
+		knownLength bool
+		trailer     http.Header
+
+		keepAlive bool
+		head      []string
+		absent    []string
+		body      string
+	}{
+		{name: "unmodified", method: "GET", proto: 1, status: 200, knownLength: true,
+			keepAlive: true, head: []string{"HTTP/1.1 200 OK", "Content-Length: 5"}, absent: []string{"Transfer-Encoding"}, body: "hello"},
+		{name: "modified", method: "GET", proto: 1, status: 200,
+			keepAlive: true, head: []string{"Transfer-Encoding: chunked"}, absent: []string{"Content-Length"}, body: "hello"},
+		{name: "trailers", method: "GET", proto: 1, status: 200, trailer: http.Header{"X-Checksum": {"abc"}},
+			keepAlive: true, head: []string{"Trailer: X-Checksum", "Transfer-Encoding: chunked"}, body: "hello"},
+		{name: "HEAD", method: "HEAD", proto: 1, status: 200, knownLength: true,
+			keepAlive: true, head: []string{"Content-Length: 5"}, absent: []string{"Transfer-Encoding"}},
+		{name: "204", method: "GET", proto: 1, status: 204, knownLength: true,
+			keepAlive: true, absent: []string{"Content-Length", "Transfer-Encoding"}},
+		{name: "304", method: "GET", proto: 1, status: 304,
+			keepAlive: true, absent: []string{"Transfer-Encoding"}},
+		{name: "HTTP/1.0", method: "GET", proto: 0, status: 200,
+			head: []string{"HTTP/1.0 200 OK", "Connection: close"}, absent: []string{"Transfer-Encoding", "Content-Length"}, body: "hello"},
+	} {
+		req, err := http.NewRequest(c.method, "http://example.test/", nil)
+		orFatal("new request", err, t)
+		req.ProtoMinor = c.proto
+		resp := &http.Response{
+			Status:        http.StatusText(c.status),
+			StatusCode:    c.status,
+			Header:        http.Header{"Content-Length": {"5"}},
+			ContentLength: 5,
+			Trailer:       c.trailer,
+		}
+		var out bytes.Buffer
+		keepAlive, err := writeHijackedResponse(&out, req, resp, strings.NewReader("hello"), c.knownLength, true, 0)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if keepAlive != c.keepAlive {
+			t.Errorf("%s: expected keep-alive %v, got %v", c.name, c.keepAlive, keepAlive)
+		}
+		raw := out.String()
+		head := raw[:strings.Index(raw, "\r\n\r\n")]
+		for _, line := range c.head {
+			if !strings.Contains(head, line) {
+				t.Errorf("%s: expected %q in %q", c.name, line, head)
+			}
+		}
+		for _, name := range c.absent {
+			if strings.Contains(head, name+":") {
+				t.Errorf("%s: expected no %s in %q", c.name, name, head)
+			}
+		}
+
+		parsed, err := http.ReadResponse(bufio.NewReader(&out), req)
+		orFatal(c.name+": read response", err, t)
+		b, err := ioutil.ReadAll(parsed.Body)
+		orFatal(c.name+": read body", err, t)
+		if string(b) != c.body {
+			t.Errorf("%s: expected body %q, got %q", c.name, c.body, b)
+		}
+		if got := parsed.Trailer.Get("X-Checksum"); c.trailer != nil && got != "abc" {
+			t.Errorf("%s: expected the trailer to be relayed, got %q", c.name, got)
+		}
+	}
+}
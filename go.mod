@@ -1,6 +1,6 @@
 module github.com/cloudveiltech/goproxy
 
-go 1.13
+go 1.19
 
 require (
 	github.com/elazarl/goproxy v0.0.0-20200220113713-29f9e0ba54ea
@@ -0,0 +1,594 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR is an HTTP Archive 1.2 document, see
+// http://www.softwareishard.com/blog/har-12-spec/.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a request and its response. Times are in milliseconds.
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	// WebSocketMessages are the messages of the websocket the request
+	// opened, in the format of the browsers
+	WebSocketMessages []HARWebSocketMessage `json:"_webSocketMessages,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+// HARPostData is a request body. Text is empty unless the recorder keeps
+// bodies, Encoding is "base64" for bodies that are not UTF-8.
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARContent is a response body, see HARPostData.
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings splits the time of an entry in milliseconds, -1 for the
+// phases that did not happen or could not be observed.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// HARWebSocketMessage is a websocket message. Time is in seconds since the
+// epoch, binary messages are base64 encoded.
+type HARWebSocketMessage struct {
+	Type   string  `json:"type"`
+	Time   float64 `json:"time"`
+	Opcode int     `json:"opcode"`
+	Data   string  `json:"data"`
+}
+
+// DefaultHAREntries is the number of entries a HARRecorder returned by
+// NewHARRecorder keeps.
+const DefaultHAREntries = 1000
+
+// DefaultRedactedHeaders are the headers a HARRecorder redacts by default.
+var DefaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// HARRecorder records the requests a proxy handles, plain or MITM'd, as
+// HAR entries, optionally along with the messages of their websockets. An
+// entry is recorded once its response body was read or its websocket ended.
+type HARRecorder struct {
+	// MaxBodySize caps the bytes of each request and response body kept
+	// in the entries. Zero keeps no body.
+	MaxBodySize int64
+	// MaxEntries caps the entries kept for WriteHAR, the oldest ones are
+	// dropped first. Zero means no cap. Streaming recorders keep none.
+	MaxEntries int
+	// WebsocketMessages, when set before Attach, records the messages of
+	// websockets. Every websocket of the proxy is then relayed message by
+	// message, see OnWebsocketMessage.
+	WebsocketMessages bool
+	// RedactHeaders lists the headers, and with Cookie and Set-Cookie the
+	// cookies, whose values entries hold as "[REDACTED]".
+	RedactHeaders []string
+	// Redact, if set, is called on every entry before it is recorded, to
+	// apply redaction rules of its own.
+	Redact func(entry *HAREntry)
+
+	proxy  *ProxyHttpServer
+	stream *json.Encoder
+
+	mu      sync.Mutex
+	entries []*HAREntry
+}
+
+// NewHARRecorder returns a recorder keeping the last DefaultHAREntries
+// entries, to be written with WriteHAR.
+func NewHARRecorder() *HARRecorder {
+	return &HARRecorder{MaxEntries: DefaultHAREntries, RedactHeaders: DefaultRedactedHeaders}
+}
+
+// NewHARStreamRecorder returns a recorder writing each entry to w as a line
+// of JSON as soon as it is recorded, keeping none.
+func NewHARStreamRecorder(w io.Writer) *HARRecorder {
+	r := NewHARRecorder()
+	r.stream = json.NewEncoder(w)
+	return r
+}
+
+// Attach has the recorder record the requests of proxy. It registers
+// request and response handlers, and websocket handlers with
+// WebsocketMessages. Attach it after the other handlers to record what is
+// sent to the server and to the client.
+func (r *HARRecorder) Attach(proxy *ProxyHttpServer) {
+	r.proxy = proxy
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		r.start(req, ctx)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		r.response(resp, ctx)
+		return resp
+	})
+	if r.WebsocketMessages {
+		proxy.OnWebsocketMessage().DoFunc(func(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage {
+			r.message(msg, ctx)
+			return []*WebsocketMessage{msg}
+		})
+	}
+}
+
+// Entries returns the entries kept so far.
+func (r *HARRecorder) Entries() []*HAREntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*HAREntry(nil), r.entries...)
+}
+
+// WriteHAR writes the entries kept so far to w as a HAR 1.2 document.
+func (r *HARRecorder) WriteHAR(w io.Writer) error {
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "goproxy", Version: "1.0"},
+		Entries: r.Entries(),
+	}}
+	if har.Log.Entries == nil {
+		har.Log.Entries = []*HAREntry{}
+	}
+	return json.NewEncoder(w).Encode(har)
+}
+
+// harCapture is an entry being recorded.
+type harCapture struct {
+	entry   *HAREntry
+	reqBody *harBody
+
+	// mu guards the times of the client trace, which the transport may
+	// call from goroutines of its own
+	mu                                 sync.Mutex
+	dnsStart, dnsDone                  time.Time
+	connectStart, connectDone          time.Time
+	tlsStart, tlsDone                  time.Time
+	gotConn, wroteRequest, gotResponse time.Time
+
+	once sync.Once
+	// finished is set once the entry is complete, guarded by the mutex of
+	// the recorder
+	finished bool
+}
+
+func (r *HARRecorder) start(req *http.Request, ctx *ProxyCtx) *harCapture {
+	c := &harCapture{entry: &HAREntry{StartedDateTime: time.Now()}}
+	e := c.entry
+	e.Request = HARRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(req.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+	for _, cookie := range req.Cookies() {
+		e.Request.Cookies = append(e.Request.Cookies, HARCookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range query[name] {
+			e.Request.QueryString = append(e.Request.QueryString, HARNameValue{name, value})
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		c.reqBody = &harBody{ReadCloser: req.Body, max: r.MaxBodySize}
+		req.Body = c.reqBody
+		e.Request.PostData = &HARPostData{MimeType: req.Header.Get("Content-Type")}
+	}
+	// in place, the handlers after this one are passed the original
+	// request
+	*req = *req.WithContext(httptrace.WithClientTrace(req.Context(), c.trace()))
+
+	ctx.setValue(r, c)
+	return c
+}
+
+func (c *harCapture) trace() *httptrace.ClientTrace {
+	now := func(t *time.Time) {
+		c.mu.Lock()
+		*t = time.Now()
+		c.mu.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { now(&c.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { now(&c.dnsDone) },
+		ConnectStart:         func(string, string) { now(&c.connectStart) },
+		ConnectDone:          func(string, string, error) { now(&c.connectDone) },
+		TLSHandshakeStart:    func() { now(&c.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { now(&c.tlsDone) },
+		GotConn:              func(httptrace.GotConnInfo) { now(&c.gotConn) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { now(&c.wroteRequest) },
+		GotFirstResponseByte: func() { now(&c.gotResponse) },
+	}
+}
+
+func (r *HARRecorder) response(resp *http.Response, ctx *ProxyCtx) {
+	c, _ := ctx.value(r).(*harCapture)
+	if c == nil {
+		// a request handler answered before the recorder saw the request
+		c = r.start(ctx.Req, ctx)
+	}
+	e := c.entry
+	if ctx.RoundTripDetails != nil && ctx.RoundTripDetails.TCPAddr != nil {
+		e.ServerIPAddress = ctx.RoundTripDetails.TCPAddr.IP.String()
+	}
+	if resp == nil {
+		if ctx.Error != nil {
+			e.Comment = ctx.Error.Error()
+		}
+		e.Response = HARResponse{Cookies: []HARCookie{}, Headers: []HARNameValue{}, HeadersSize: -1, BodySize: -1}
+		r.finish(c, ctx, nil, time.Now())
+		return
+	}
+
+	received := time.Now()
+	c.mu.Lock()
+	if c.gotResponse.IsZero() {
+		c.gotResponse = received
+	}
+	c.mu.Unlock()
+	statusText := resp.Status
+	if i := strings.IndexByte(statusText, ' '); i >= 0 {
+		statusText = statusText[i+1:]
+	}
+	e.Response = HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  statusText,
+		HTTPVersion: resp.Proto,
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(resp.Header),
+		Content:     HARContent{Size: -1, MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	for _, cookie := range resp.Cookies() {
+		hc := HARCookie{Name: cookie.Name, Value: cookie.Value, Path: cookie.Path, Domain: cookie.Domain, HTTPOnly: cookie.HttpOnly, Secure: cookie.Secure}
+		if !cookie.Expires.IsZero() {
+			expires := cookie.Expires
+			hc.Expires = &expires
+		}
+		e.Response.Cookies = append(e.Response.Cookies, hc)
+	}
+
+	if ctx.Req != nil && r.proxy.isUpgradeRequest(ctx.Req) && switchedProtocols(ctx.Req, resp) {
+		// the entry ends with the protocol switched to
+		ctx.afterUpgrade(func() {
+			r.finish(c, ctx, nil, received)
+		})
+		return
+	}
+	body := &harBody{ReadCloser: resp.Body, max: r.MaxBodySize}
+	body.done = func() {
+		r.finish(c, ctx, body, time.Now())
+	}
+	resp.Body = body
+}
+
+func (r *HARRecorder) message(msg *WebsocketMessage, ctx *ProxyCtx) {
+	c, _ := ctx.value(r).(*harCapture)
+	if c == nil {
+		return
+	}
+	m := HARWebSocketMessage{Type: "receive", Opcode: msg.Type, Data: string(msg.Data)}
+	if msg.FromClient {
+		m.Type = "send"
+	}
+	if msg.Type == WebsocketBinary {
+		m.Data = base64.StdEncoding.EncodeToString(msg.Data)
+	}
+	m.Time = float64(time.Now().UnixNano()) / float64(time.Second)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !c.finished {
+		c.entry.WebSocketMessages = append(c.entry.WebSocketMessages, m)
+	}
+}
+
+// finish records the entry of c, whose response body, if any, was read
+// through respBody until end.
+func (r *HARRecorder) finish(c *harCapture, ctx *ProxyCtx, respBody *harBody, end time.Time) {
+	c.once.Do(func() {
+		r.mu.Lock()
+		c.finished = true
+		r.mu.Unlock()
+
+		e := c.entry
+		if c.reqBody != nil {
+			data, size, truncated := c.reqBody.recorded()
+			e.Request.BodySize = size
+			e.Request.PostData.Text, e.Request.PostData.Encoding = harText(data)
+			if truncated {
+				e.Request.PostData.Comment = "truncated to " + strconv.FormatInt(r.MaxBodySize, 10) + " bytes"
+			}
+		}
+		if respBody != nil {
+			data, size, truncated := respBody.recorded()
+			e.Response.BodySize = size
+			e.Response.Content.Size = size
+			e.Response.Content.Text, e.Response.Content.Encoding = harText(data)
+			if truncated {
+				e.Response.Content.Comment = "truncated to " + strconv.FormatInt(r.MaxBodySize, 10) + " bytes"
+			}
+		}
+		c.timings(end)
+		r.redact(e)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.stream != nil {
+			if err := r.stream.Encode(e); err != nil {
+				ctx.Warnf("Cannot write HAR entry: %v", err)
+			}
+			return
+		}
+		if r.MaxEntries > 0 && len(r.entries) >= r.MaxEntries {
+			n := copy(r.entries, r.entries[len(r.entries)-r.MaxEntries+1:])
+			for i := n; i < len(r.entries); i++ {
+				r.entries[i] = nil
+			}
+			r.entries = r.entries[:n]
+		}
+		r.entries = append(r.entries, e)
+	})
+}
+
+// timings fills the timings of the entry from the client trace. When the
+// trace saw no connection, as for the requests of MITM'd tunnels sent
+// through their own transport, the time before the response is all wait.
+func (c *harCapture) timings(end time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return -1
+		}
+		return float64(to.Sub(from)) / float64(time.Millisecond)
+	}
+	t := HARTimings{
+		Blocked: -1,
+		DNS:     ms(c.dnsStart, c.dnsDone),
+		Connect: ms(c.connectStart, c.connectDone),
+		SSL:     ms(c.tlsStart, c.tlsDone),
+		Wait:    ms(e.StartedDateTime, c.gotResponse),
+		Receive: ms(c.gotResponse, end),
+	}
+	if t.SSL >= 0 && t.Connect >= 0 {
+		// connect includes the TLS handshake
+		t.Connect = ms(c.connectStart, c.tlsDone)
+	}
+	if !c.gotConn.IsZero() && !c.wroteRequest.IsZero() {
+		t.Blocked = ms(e.StartedDateTime, c.gotConn)
+		for _, phase := range []float64{t.DNS, t.Connect} {
+			if phase > 0 {
+				t.Blocked -= phase
+			}
+		}
+		if t.Blocked < 0 {
+			t.Blocked = 0
+		}
+		t.Send = ms(c.gotConn, c.wroteRequest)
+		t.Wait = ms(c.wroteRequest, c.gotResponse)
+	}
+	for _, phase := range []*float64{&t.Send, &t.Wait, &t.Receive} {
+		if *phase < 0 {
+			*phase = 0
+		}
+	}
+	e.Timings = t
+	e.Time = t.Send + t.Wait + t.Receive
+	for _, phase := range []float64{t.Blocked, t.DNS, t.Connect} {
+		if phase > 0 {
+			e.Time += phase
+		}
+	}
+}
+
+func (r *HARRecorder) redact(e *HAREntry) {
+	redacted := func(name string) bool {
+		for _, h := range r.RedactHeaders {
+			if strings.EqualFold(h, name) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, headers := range [][]HARNameValue{e.Request.Headers, e.Response.Headers} {
+		for i := range headers {
+			if redacted(headers[i].Name) {
+				headers[i].Value = "[REDACTED]"
+			}
+		}
+	}
+	if redacted("Cookie") {
+		for i := range e.Request.Cookies {
+			e.Request.Cookies[i].Value = "[REDACTED]"
+		}
+	}
+	if redacted("Set-Cookie") {
+		for i := range e.Response.Cookies {
+			e.Response.Cookies[i].Value = "[REDACTED]"
+		}
+	}
+	if r.Redact != nil {
+		r.Redact(e)
+	}
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, value := range h[name] {
+			headers = append(headers, HARNameValue{name, value})
+		}
+	}
+	return headers
+}
+
+// harText returns data as HAR text and its encoding, base64 when it is not
+// UTF-8.
+func harText(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+// harBody records up to max bytes of the body it wraps and counts all the
+// bytes read from it. done, if set, is called once the body was read to its
+// end or closed.
+type harBody struct {
+	io.ReadCloser
+	max  int64
+	done func()
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	size      int64
+	truncated bool
+	once      sync.Once
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.size += int64(n)
+	if keep := b.max - int64(b.buf.Len()); keep > 0 {
+		if int64(n) > keep {
+			b.buf.Write(p[:keep])
+			b.truncated = true
+		} else {
+			b.buf.Write(p[:n])
+		}
+	} else if n > 0 && b.max > 0 {
+		b.truncated = true
+	}
+	b.mu.Unlock()
+	if err == io.EOF {
+		b.end()
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end()
+	return err
+}
+
+func (b *harBody) end() {
+	if b.done != nil {
+		b.once.Do(b.done)
+	}
+}
+
+func (b *harBody) unwrapBody() io.ReadCloser {
+	return b.ReadCloser
+}
+
+// recorded returns what was kept of the body, the number of bytes read from
+// it and whether some were not kept.
+func (b *harBody) recorded() ([]byte, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.size, b.truncated
+}
@@ -0,0 +1,173 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entryWriter passes every entry a streaming recorder writes to a channel.
+type entryWriter chan *HAREntry
+
+func (w entryWriter) Write(p []byte) (int, error) {
+	var e HAREntry
+	if err := json.Unmarshal(p, &e); err != nil {
+		return 0, err
+	}
+	w <- &e
+	return len(p), nil
+}
+
+func nextEntry(t *testing.T, entries entryWriter) *HAREntry {
+	select {
+	case e := <-entries:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no HAR entry recorded")
+		return nil
+	}
+}
+
+func TestHARRecordsRequests(t *testing.T) {
+	var conns int32
+	upstream := echoServer(&conns)
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	recorder := NewHARRecorder()
+	recorder.MaxBodySize = 4
+	recorder.Attach(proxy)
+	srv := httptest.NewServer(proxy)
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	req, err := http.NewRequest("POST", upstream.URL+"/path?b=2&a=1", strings.NewReader("hello"))
+	orFatal("new request", err, t)
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	resp, err := client.Do(req)
+	orFatal("request through proxy", err, t)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// waits for the proxy to be done with the request
+	srv.Close()
+
+	var buf bytes.Buffer
+	orFatal("write HAR", recorder.WriteHAR(&buf), t)
+	var har HAR
+	orFatal("decode HAR", json.Unmarshal(buf.Bytes(), &har), t)
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+		t.Fatalf("unexpected HAR %s", buf.Bytes())
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != "POST" || e.Request.URL != upstream.URL+"/path?b=2&a=1" {
+		t.Errorf("unexpected request %s %s", e.Request.Method, e.Request.URL)
+	}
+	if q := e.Request.QueryString; len(q) != 2 || q[0] != (HARNameValue{"a", "1"}) || q[1] != (HARNameValue{"b", "2"}) {
+		t.Errorf("unexpected query string %v", q)
+	}
+	for _, h := range e.Request.Headers {
+		if h.Name == "Authorization" && h.Value != "[REDACTED]" {
+			t.Errorf("Authorization recorded as %q", h.Value)
+		}
+	}
+	if p := e.Request.PostData; p == nil || p.Text != "hell" || p.Comment == "" || e.Request.BodySize != 5 {
+		t.Errorf("unexpected request body %+v of %d bytes", p, e.Request.BodySize)
+	}
+	if c := e.Response.Content; e.Response.Status != http.StatusOK || c.Text != "POST" || c.Size != int64(len("POST /path hello")) {
+		t.Errorf("unexpected response %d %+v", e.Response.Status, c)
+	}
+	if e.Time <= 0 || e.Timings.Wait <= 0 {
+		t.Errorf("unexpected timings %+v", e.Timings)
+	}
+}
+
+func TestHARKeepsLastEntries(t *testing.T) {
+	var conns int32
+	upstream := echoServer(&conns)
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	recorder := NewHARRecorder()
+	recorder.MaxEntries = 2
+	recorder.Attach(proxy)
+	if len(proxy.websocketHandlers) != 0 {
+		t.Error("expected no websocket handler without WebsocketMessages")
+	}
+	srv := httptest.NewServer(proxy)
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for _, path := range []string{"/1", "/2", "/3"} {
+		resp, err := client.Get(upstream.URL + path)
+		orFatal("request through proxy", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	srv.Close()
+
+	entries := recorder.Entries()
+	if len(entries) != 2 || entries[0].Request.URL != upstream.URL+"/2" || entries[1].Request.URL != upstream.URL+"/3" {
+		t.Errorf("expected the last 2 entries, got %d", len(entries))
+	}
+}
+
+func TestHARRecordsHTTPMitm(t *testing.T) {
+	var conns int32
+	upstream := echoServer(&conns)
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	entries := make(entryWriter, 1)
+	conn, r, done := httpMitmTunnel(t, addr, func(proxy *ProxyHttpServer) {
+		NewHARStreamRecorder(entries).Attach(proxy)
+	})
+	defer done()
+	_, err := conn.Write([]byte("GET /mitm HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+	orFatal("write request", err, t)
+	readBody(t, r)
+
+	e := nextEntry(t, entries)
+	if e.Request.URL != "http://"+addr+"/mitm" || e.Response.Status != http.StatusOK {
+		t.Errorf("unexpected entry %s %d", e.Request.URL, e.Response.Status)
+	}
+	if c := e.Response.Content; c.Text != "" || c.Size != int64(len("GET /mitm ")) {
+		t.Errorf("unexpected content %+v", c)
+	}
+}
+
+func TestHARRecordsWebsocketMessages(t *testing.T) {
+	upstream := websocketEchoServer(t)
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	entries := make(entryWriter, 1)
+	recorder := NewHARStreamRecorder(entries)
+	recorder.WebsocketMessages = true
+	recorder.Attach(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, r := websocketThroughProxy(t, srv.Listener.Addr().String(), upstream.URL+"/chat")
+	defer conn.Close()
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketText, payload: []byte("hello")}, true)
+	f, err := readWSFrame(r, maxWebsocketMessage)
+	orFatal("read frame", err, t)
+	if string(f.payload) != "echo: hello" {
+		t.Errorf("unexpected message %q", f.payload)
+	}
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketClose}, true)
+
+	e := nextEntry(t, entries)
+	if e.Response.Status != http.StatusSwitchingProtocols {
+		t.Errorf("unexpected response %d", e.Response.Status)
+	}
+	m := e.WebSocketMessages
+	if len(m) != 2 || m[0].Type != "send" || m[0].Data != "hello" || m[1].Type != "receive" || m[1].Data != "echo: hello" {
+		t.Errorf("unexpected messages %+v", m)
+	}
+}
@@ -2,10 +2,8 @@ package goproxy
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -45,19 +43,38 @@ type ConnectAction struct {
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
 }
 
+// stripPort returns the host of a host:port address. Addresses without a
+// port are returned as is, minus the brackets of an IPv6 literal.
 func stripPort(s string) string {
-	ix := strings.IndexRune(s, ':')
-	if ix == -1 {
-		return s
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
 	}
-	return s[:ix]
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// hasPort reports whether a host:port address has a port, bare IPv6
+// literals such as ::1 have none.
+func hasPort(s string) bool {
+	_, port, err := net.SplitHostPort(s)
+	return err == nil && port != ""
+}
+
+// withDefaultPort returns addr with port added if it has none.
+func withDefaultPort(addr, port string) string {
+	if hasPort(addr) {
+		return addr
+	}
+	return net.JoinHostPort(stripPort(addr), port)
 }
 
 func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
 	if proxy.Tr.Dial != nil {
 		return proxy.Tr.Dial(network, addr)
 	}
-	return net.Dial(network, addr)
+	return proxy.dialTimeout(network, addr)
 }
 
 func (proxy *ProxyHttpServer) connectDial(network, addr string) (c net.Conn, err error) {
@@ -87,6 +104,14 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	if e != nil {
 		panic("Cannot hijack connection " + e.Error())
 	}
+	if authResp := proxy.checkProxyAuth(r, ctx); authResp != nil {
+		authResp.Close = true
+		if err := authResp.Write(proxyClient); err != nil {
+			ctx.Warnf("Cannot write proxy authentication challenge: %v", err)
+		}
+		proxyClient.Close()
+		return
+	}
 
 	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
 	todo, host := OkConnect, r.URL.Host
@@ -100,34 +125,50 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			break
 		}
 	}
+	release := func() {}
 	switch todo.Action {
-	case ConnectAccept:
-		if !hasPort.MatchString(host) {
-			host += ":80"
+	case ConnectAccept, ConnectMitm, ConnectHTTPMitm:
+		var limitErr *LimitError
+		if release, limitErr = proxy.acquireConn(r, host); limitErr != nil {
+			ctx.Warnf("Rejecting CONNECT to %s: %v", host, limitErr)
+			ctx.Error = limitErr
+			ctx.Resp = limitResponse(r, limitErr)
+			todo = RejectConnect
 		}
+	}
+	switch todo.Action {
+	case ConnectAccept:
+		host = withDefaultPort(host, "80")
 		targetSiteCon, err := proxy.connectDial("tcp", host)
 		if err != nil {
+			release()
 			httpError(proxyClient, ctx, err)
 			return
 		}
 		ctx.Logf("Accepting CONNECT to %s", host)
 		proxyClient.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		targetSiteCon = withIdleTimeout(targetSiteCon, proxy.Timeouts.TunnelIdle)
+		proxyClient = withIdleTimeout(proxyClient, proxy.Timeouts.TunnelIdle)
 
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyClient.(halfClosable)
+		var wg sync.WaitGroup
+		wg.Add(2)
 		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
+			go copyAndClose(ctx, targetTCP, proxyClientTCP, &wg)
+			go copyAndClose(ctx, proxyClientTCP, targetTCP, &wg)
+			go func() {
+				wg.Wait()
+				release()
+			}()
 		} else {
 			go func() {
-				var wg sync.WaitGroup
-				wg.Add(2)
 				go copyOrWarn(ctx, targetSiteCon, proxyClient, &wg)
 				go copyOrWarn(ctx, proxyClient, targetSiteCon, &wg)
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
-
+				release()
 			}()
 		}
 
@@ -136,42 +177,48 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		todo.Hijack(r, proxyClient, ctx)
 	case ConnectHTTPMitm:
+		defer release()
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
-		targetSiteCon, err := proxy.connectDial("tcp", host)
-		if err != nil {
-			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
-			return
+		defer proxyClient.Close()
+		upstream := &plainUpstream{
+			dial: func() (net.Conn, error) {
+				return proxy.connectDial("tcp", host)
+			},
+			expectContinueTimeout: proxy.Tr.ExpectContinueTimeout,
 		}
-		for {
-			client := bufio.NewReader(proxyClient)
-			remote := bufio.NewReader(targetSiteCon)
-			req, err := http.ReadRequest(client)
-			if err != nil && err != io.EOF {
-				ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
+		defer upstream.close()
+		c := newMitmConn(proxy, newTunnelCtx(ctx, "", ""), proxyClient)
+		c.prepare = func(ctx *ProxyCtx, req *http.Request) error {
+			req.URL.Scheme = "http"
+			if req.URL.Host == "" {
+				req.URL.Host = req.Host
 			}
-			if err != nil {
-				return
+			return nil
+		}
+		c.upgrade = func(ctx *ProxyCtx, req *http.Request) bool {
+			if !proxy.isUpgradeRequest(req) {
+				return false
 			}
-			req, resp := proxy.filterRequest(req, ctx)
-			if resp == nil {
-				if err := req.Write(targetSiteCon); err != nil {
-					httpError(proxyClient, ctx, err)
-					return
-				}
-				resp, err = http.ReadResponse(remote, req)
-				if err != nil {
-					httpError(proxyClient, ctx, err)
-					return
-				}
-				defer resp.Body.Close()
+			ctx.Logf("Request looks like protocol upgrade.")
+			remote, err := proxy.connectDial("tcp", host)
+			if err != nil {
+				httpError(proxyClient, ctx, err)
+				return true
 			}
-			resp = proxy.filterResponse(resp, ctx)
-			if err := resp.Write(proxyClient); err != nil {
+			defer remote.Close()
+			if err := proxy.writeUpgradeRequest(remote, req); err != nil {
 				httpError(proxyClient, ctx, err)
-				return
+				return true
 			}
+			client, upstream := proxy.tunnelConns(c.clientConn(), remote)
+			proxy.relayUpgrade(ctx, req, client, upstream)
+			return true
 		}
+		c.roundTrip = func(ctx *ProxyCtx, req *http.Request) (*http.Response, error) {
+			return upstream.roundTrip(req)
+		}
+		c.serve()
 	case ConnectMitm:
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
@@ -184,15 +231,18 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			var err error
 			tlsConfig, err = todo.TLSConfig(host, ctx)
 			if err != nil {
+				release()
 				httpError(proxyClient, ctx, err)
 				return
 			}
 		}
+		// the handshake fills in the config for the tunnel, defaultTLSConfig
+		// and the configs of TLSConfig may be shared
+		tlsConfig = tlsConfig.Clone()
 
 		go func() {
-			//TODO: cache connections to the remote website
+			defer release()
 			tlsConfig.Renegotiation = tls.RenegotiateFreelyAsClient
-			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
 			var err error
 			var proxyURL *url.URL
 			var roundTripper http.RoundTripper
@@ -204,40 +254,46 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					host = proxyURL.Host
 				}
 			}
-			if host != r.Host {
-				tlsConfig.NextProtos = []string{"http/1.1"}
-			}
-
-			remote := dialTls(host, r, ctx, tlsConfig)
 
-			if remote == nil {
-				tlsConfig.NextProtos = []string{"http/1.1"}
-				rawClientTls := tls.Server(proxyClient, tlsConfig)
-				rawClientTls.Handshake()
-				rawClientTls.ConnectionState()
-				httpError(rawClientTls, ctx, fmt.Errorf("Can't dial remote"))
-				return
+			// The upstream connection is dialed once the client's ClientHello
+			// is known, offering the client's ALPN and SNI, and the client
+			// handshake then completes with whatever upstream agreed to.
+			var remote io.ReadWriteCloser
+			var dialErr error
+			serverConfig := tlsConfig.Clone()
+			serverConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				tlsConfig.NextProtos = upstreamProtos(hello.SupportedProtos, host != r.Host || proxy.Http2Handler == nil)
+				if hello.ServerName != "" {
+					tlsConfig.ServerName = hello.ServerName
+				}
+				remote, dialErr = dialTls(host, r, ctx, tlsConfig)
+				// the upstream dial does not count against the client handshake
+				proxyClient.SetDeadline(deadline(proxy.Timeouts.TLSHandshake))
+
+				config := tlsConfig.Clone()
+				config.GetConfigForClient = nil
+				config.NextProtos = []string{"http/1.1"}
+				if uconn, ok := remote.(*tls.UConn); ok {
+					config.NextProtos = clientProtos(uconn.ConnectionState().NegotiatedProtocol, hello.SupportedProtos)
+				}
+				return config, nil
 			}
 
-			rawClientTls := tls.Server(proxyClient, tlsConfig)
-			if err := rawClientTls.Handshake(); err != nil {
+			rawClientTls := tls.Server(proxyClient, serverConfig)
+			if err := handshakeTimeout(proxyClient, proxy.Timeouts.TLSHandshake, rawClientTls.Handshake); err != nil {
 				ctx.Warnf("Cannot handshake Server %v %v", r.Host, err)
+				if remote != nil {
+					remote.Close()
+				}
+				proxyClient.Close()
 				return
 			}
+			clientState := rawClientTls.ConnectionState()
+			tunnel := newTunnelCtx(ctx, clientState.ServerName, clientState.NegotiatedProtocol)
 
-			clientHttpProtocol := rawClientTls.ConnectionState().NegotiatedProtocol
-			if clientHttpProtocol != remote.(*tls.UConn).ConnectionState().NegotiatedProtocol {
-				remote.Close()
-				tlsConfig.NextProtos = []string{clientHttpProtocol}
-				remote = dialTls(host, r, ctx, tlsConfig)
-				if remote == nil {
-					tlsConfig.NextProtos = []string{"http/1.1"}
-					rawClientTls := tls.Server(proxyClient, tlsConfig)
-					rawClientTls.Handshake()
-					rawClientTls.ConnectionState()
-					httpError(rawClientTls, ctx, fmt.Errorf("Can't dial remote"))
-					return
-				}
+			if remote == nil {
+				proxy.respondDialError(tunnel, rawClientTls, r, dialErr)
+				return
 			}
 
 			if rawClientTls.ConnectionState().NegotiatedProtocol != "h2" {
@@ -259,7 +315,17 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				tlsConfig.NextProtos = []string{"http/1.1", "h2"}
 				tlsConfig.MinVersion = tls.VersionTLS12
 				tlsConfig.InsecureSkipVerify = true
-				roundTripper, err = NewUTLSRoundTripper("hellorandomizednoalpn_maxtls", tlsConfig, proxyURL)
+				// requests start with the fingerprint the probe
+				// connection handshook with
+				clientHelloID := RandomizedMaxTlsHelloIdNoALPN
+				if uconn, ok := remote.(*tls.UConn); ok {
+					clientHelloID = uconn.ClientHelloID
+				}
+				if proxy.ConnPool != nil {
+					roundTripper, err = proxy.ConnPool.roundTripper(&clientHelloID, tlsConfig, proxyURL, "http/1.1", proxy)
+				} else {
+					roundTripper, err = newUTLSRoundTripper(&clientHelloID, tlsConfig, proxyURL, proxy.Fingerprints)
+				}
 				if err != nil {
 					log.Printf("Cannot connect: %s %v", r.Host, err)
 					httpError(rawClientTls, ctx, err)
@@ -267,127 +333,76 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				}
 			}
 
-			//	defer remote.Close()
-			//	defer rawClientTls.Close()
-			clientTlsReader := bufio.NewReader(rawClientTls)
-			for !isEof(clientTlsReader) {
-				req, err := http.ReadRequest(clientTlsReader)
-				if err != nil {
-					ctx.Warnf("error read request %v", err)
-					return
-				}
-				if strings.Contains(req.Method, "RDG") { //remote desktop gateway
-					cp := func(dst io.Writer, src io.Reader) {
-						io.Copy(dst, src)
-					}
+			var remoteState tls.ConnectionState
+			if uconn, ok := remote.(*tls.UConn); ok {
+				remoteState = uconn.ConnectionState()
+			}
+			if roundTripper != nil {
+				// requests go through roundTripper, the probe connection is
+				// only needed again for upgrades, leave it to other tunnels
+				// until then
+				releaseRemote(ctx, remote, host)
+				remote = nil
+			}
 
-					req.Write(remote)
-					// Start proxying websocket data
-					go cp(rawClientTls, remote)
-					cp(remote, rawClientTls)
-					return
+			c := newMitmConn(proxy, tunnel, rawClientTls)
+			defer func() {
+				rawClientTls.Close()
+				if remote != nil {
+					remote.Close()
 				}
-				var ctx = &ProxyCtx{Req: req, Session: atomic.AddInt64(&proxy.sess, 1), proxy: proxy, UserData: ctx.UserData}
-				if err != nil && err != io.EOF {
-					return
-				}
-				if err != nil {
-					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
-					return
-				}
-
-				req.RemoteAddr = r.RemoteAddr // since we're converting the request, need to carry over the original connecting IP as well
+			}()
+			c.prepare = func(ctx *ProxyCtx, req *http.Request) error {
 				ctx.Logf("req %v", r.Host)
-
-				if !httpsRegexp.MatchString(req.URL.String()) {
-					req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
-				}
-				if isWebSocketRequest(req) {
-					ctx.Logf("Request looks like websocket upgrade.")
-					err := req.Write(remote)
-					if err != nil {
-						httpError(rawClientTls, ctx, err)
-						return
-					}
-					go func() {
-						io.Copy(remote, rawClientTls)
-					}()
-					io.Copy(rawClientTls, remote)
-					return
-				}
-				// Bug fix which goproxy fails to provide request
-				// information URL in the context when does HTTPS MITM
-				ctx.Req = req
-
-				req, resp := proxy.filterRequest(req, ctx)
-				if resp == nil {
-					if err != nil {
-						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
-						return
-					}
-					//	removeProxyHeaders(ctx, req)
-					if roundTripper == nil {
-						resp, err = ctx.RoundTrip(req)
-					} else {
-						resp, err = roundTripper.RoundTrip(req)
-					}
+				state := remoteState
+				ctx.ConnectionState = &state
+				// a CONNECT keeps its authority form, the tunnel server
+				// is asked to open another tunnel
+				if req.Method != "CONNECT" && !httpsRegexp.MatchString(req.URL.String()) {
+					u, err := url.Parse("https://" + r.Host + req.URL.String())
 					if err != nil {
-						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-
-						httpError(rawClientTls, ctx, err)
-						rawClientTls.Close()
-						remote.Close()
-						return
+						return err
 					}
-					ctx.Logf("resp %v", resp.Status)
-				}
-				state := remote.(*tls.UConn).ConnectionState()
-				ctx.ConnectionState = &state
-				resp = proxy.filterResponse(resp, ctx)
-				defer resp.Body.Close()
-
-				text := resp.Status
-
-				statusCode := strconv.Itoa(resp.StatusCode) + " "
-				if strings.HasPrefix(text, statusCode) {
-					text = text[len(statusCode):]
+					req.URL = u
 				}
-				// always use 1.1 to support chunked encoding
-				if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
-					return
+				return nil
+			}
+			c.upgrade = func(ctx *ProxyCtx, req *http.Request) bool {
+				if !proxy.isUpgradeRequest(req) {
+					return false
 				}
-				// Since we don't know the length of resp, return chunked encoded response
-				// TODO: use a more reasonable scheme
-				resp.Header.Del("Content-Length")
-				resp.Header.Set("Transfer-Encoding", "chunked")
-				// Force connection close otherwise chrome will keep CONNECT tunnel open forever
-				//	resp.Header.Set("Connection", "close")
-				if err := resp.Header.Write(rawClientTls); err != nil {
-					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
-					return
+				ctx.Logf("Request looks like protocol upgrade.")
+				// a connection of its own, the probe connection may
+				// speak h2 or lead to the upstream proxy
+				target := req
+				if req.Method == "CONNECT" {
+					target = &http.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: r.Host}, Header: http.Header{}}
 				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response header end from mitm'd client: %v", err)
-					return
+				upgradeConfig := proxy.WebsocketTLSConfig
+				if upgradeConfig == nil {
+					upgradeConfig = &tls.Config{InsecureSkipVerify: tlsConfig.InsecureSkipVerify, ServerName: tlsConfig.ServerName}
 				}
-				chunked := newChunkedWriter(rawClientTls)
-				var written int64 = 1
-				for written > 0 {
-					written, _ = io.Copy(chunked, resp.Body)
-					//ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
-					//return
+				upgradeRemote, err := proxy.dialUpgrade(ctx, target, upgradeConfig)
+				if err != nil {
+					httpError(rawClientTls, ctx, err)
+					return true
 				}
-				if err := chunked.Close(); err != nil {
-					ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
-					return
+				defer upgradeRemote.Close()
+				if err := proxy.writeUpgradeRequest(upgradeRemote, req); err != nil {
+					httpError(rawClientTls, ctx, err)
+					return true
 				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
-					return
+				client, upstream := proxy.tunnelConns(c.clientConn(), upgradeRemote)
+				proxy.relayUpgrade(ctx, req, client, upstream)
+				return true
+			}
+			c.roundTrip = func(ctx *ProxyCtx, req *http.Request) (*http.Response, error) {
+				if roundTripper == nil {
+					return ctx.RoundTrip(req)
 				}
+				return ctx.recordRoundTrip(req, proxyURL, roundTripper.RoundTrip)
 			}
-			ctx.Logf("Exiting on EOF")
+			c.serve()
 		}()
 	case ConnectProxyAuthHijack:
 		proxyClient.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n"))
@@ -402,51 +417,208 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func dialTls(host string, r *http.Request, ctx *ProxyCtx, tlsConfig *tls.Config) io.ReadWriteCloser {
-	tcpConn, err := net.Dial("tcp", host)
-	if err != nil {
-		log.Printf("Cannot dial: %s %v", r.Host, err)
-		return nil
+func dialTls(host string, r *http.Request, ctx *ProxyCtx, tlsConfig *tls.Config) (io.ReadWriteCloser, error) {
+	if host != r.Host {
+		tcpConn, err := ctx.dial("tcp", host)
+		if err != nil {
+			log.Printf("Cannot dial: %s %v", r.Host, err)
+			return nil, err
+		}
+		return tcpConn, nil
 	}
 
-	var remote io.ReadWriteCloser = tcpConn
-	if host == r.Host {
-		clientHelloId := tls.HelloChrome_Auto
-		invalidProtos := false
-		for _, proto := range tlsConfig.NextProtos {
-			if len(proto) == 0 || []rune(proto)[0] != 'h' {
-				invalidProtos = true
-				break
-			}
+	clientHelloId := tls.HelloChrome_Auto
+	invalidProtos := false
+	for _, proto := range tlsConfig.NextProtos {
+		if len(proto) == 0 || []rune(proto)[0] != 'h' {
+			invalidProtos = true
+			break
+		}
+	}
+	if invalidProtos {
+		log.Printf("Invalid NextProtos detected for host %s", host)
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	// a connection without ALPN is what the randomized NoALPN hello negotiates
+	acceptedProtos := tlsConfig.NextProtos
+	if len(tlsConfig.NextProtos) > 0 && tlsConfig.NextProtos[0] != "h2" {
+		clientHelloId = tls.HelloRandomizedNoALPN
+		acceptedProtos = []string{""}
+	}
+
+	candidates := []tls.ClientHelloID{clientHelloId}
+	offered := append([]string(nil), tlsConfig.NextProtos...)
+	var alpn string
+	if len(offered) > 0 {
+		alpn = offered[0]
+	}
+	if selector := ctx.proxy.Fingerprints; selector != nil {
+		candidates = selector.Candidates(host, alpn, clientHelloId)
+	}
+
+	var remoteTls *tls.UConn
+	if pool := ctx.proxy.ConnPool; pool != nil {
+		remoteTls = pool.Get(host, candidates[0], acceptedProtos...)
+		if remoteTls != nil {
+			ctx.Logf("Reusing pooled connection to %s", host)
+		}
+	}
+	var lastErr error
+	for i := 0; remoteTls == nil && i < len(candidates); i++ {
+		// a failed handshake may have left NextProtos modified
+		tlsConfig.NextProtos = offered
+		tcpConn, err := ctx.dial("tcp", host)
+		if err != nil {
+			log.Printf("Cannot dial: %s %v", r.Host, err)
+			return nil, err
+		}
+		remoteTls, err = handshakeUpstream(ctx, tcpConn, tlsConfig, candidates[i])
+		if err != nil {
+			log.Printf("Cannot handshake: %s with %s %v", r.Host, helloKey(candidates[i]), err)
+			lastErr = err
+			continue
 		}
-		if invalidProtos {
-			log.Printf("Invalid NextProtos detected for host %s", host)
-			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		if selector := ctx.proxy.Fingerprints; selector != nil {
+			selector.Learn(host, alpn, candidates[i])
 		}
+	}
+	if remoteTls == nil {
+		return nil, lastErr
+	}
 
-		if len(tlsConfig.NextProtos) > 0 && tlsConfig.NextProtos[0] != "h2" {
-			clientHelloId = tls.HelloRandomizedNoALPN
+	if remoteTls.ConnectionState().NegotiatedProtocol != "h2" {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	} else {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return remoteTls, nil
+}
+
+// handshakeUpstream performs a client handshake on tcpConn using
+// clientHelloId, closing it on failure. A handshake negotiating an ALPN
+// protocol that tlsConfig did not offer fails.
+func handshakeUpstream(ctx *ProxyCtx, tcpConn net.Conn, tlsConfig *tls.Config, clientHelloId tls.ClientHelloID) (*tls.UConn, error) {
+	offered := tlsConfig.NextProtos
+	cache := ctx.proxy.SessionCache
+	if cache != nil {
+		tlsConfig.ClientSessionCache = cache.ForHello(clientHelloId)
+	}
+	remoteTls, handshake := uClient(tcpConn, tlsConfig, clientHelloId)
+	if err := handshakeTimeout(tcpConn, ctx.proxy.Timeouts.TLSHandshake, handshake); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	if cache != nil {
+		cache.recordHandshake(remoteTls.ConnectionState())
+	}
+	if proto := remoteTls.ConnectionState().NegotiatedProtocol; proto != "" {
+		accepted := false
+		for _, p := range offered {
+			accepted = accepted || p == proto
+		}
+		if !accepted {
+			remoteTls.Close()
+			return nil, fmt.Errorf("server negotiated unexpected ALPN %q", proto)
 		}
+	}
+	return remoteTls, nil
+}
 
-		remoteTls := tls.UClient(tcpConn, tlsConfig, clientHelloId)
-		err = remoteTls.Handshake()
-		if err != nil {
-			log.Printf("Cannot handshake: %s %v", r.Host, err)
-			return nil
+// upstreamProtos returns the ALPN protocols to offer upstream for a client
+// that offered offered. Only HTTP protocols are passed on, h2 only when the
+// proxy can relay it.
+func upstreamProtos(offered []string, http1Only bool) []string {
+	var protos []string
+	for _, proto := range offered {
+		if proto == "http/1.1" || (proto == "h2" && !http1Only) {
+			protos = append(protos, proto)
 		}
+	}
+	if len(protos) == 0 {
+		protos = []string{"http/1.1"}
+	}
+	return protos
+}
 
-		if remoteTls.ConnectionState().NegotiatedProtocol != "h2" {
-			tlsConfig.NextProtos = []string{"http/1.1"}
-		} else {
-			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+// clientProtos returns the ALPN protocols to accept from the client once
+// upstream negotiated upstream. A server without ALPN speaks http/1.1, and if
+// the client did not offer the protocol, no ALPN is negotiated at all.
+func clientProtos(upstream string, offered []string) []string {
+	if upstream == "" {
+		upstream = "http/1.1"
+	}
+	for _, proto := range offered {
+		if proto == upstream {
+			return []string{upstream}
 		}
-		remote = remoteTls
 	}
-	return remote
+	return nil
+}
+
+// respondDialError answers the first request of a MITM'd client whose
+// upstream could not be reached. Response handlers see the dial error in
+// ctx.Error and may provide their own response, otherwise a 502 is sent.
+func (proxy *ProxyHttpServer) respondDialError(tunnel *TunnelCtx, client *tls.Conn, r *http.Request, dialErr error) {
+	ctx := tunnel.Ctx
+	defer client.Close()
+	reader := bufio.NewReader(client)
+	if !proxy.awaitRequest(ctx, client, reader) {
+		return
+	}
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		ctx.Warnf("Cannot read request after failing to dial %v: %v", r.Host, dialErr)
+		return
+	}
+	if !httpsRegexp.MatchString(req.URL.String()) {
+		if u, err := url.Parse("https://" + r.Host + req.URL.String()); err == nil {
+			req.URL = u
+		}
+	}
+	req.RemoteAddr = r.RemoteAddr
+	reqCtx := tunnel.newCtx(req)
+	reqCtx.Error = fmt.Errorf("cannot dial %s: %v", r.Host, dialErr)
+	reqCtx.Warnf("%v", reqCtx.Error)
+
+	resp := proxy.filterResponse(nil, reqCtx)
+	if resp == nil {
+		resp = NewResponse(req, ContentTypeText, errorStatus(dialErr, http.StatusBadGateway), reqCtx.Error.Error())
+	}
+	defer resp.Body.Close()
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Close = true
+	if err := resp.Write(client); err != nil {
+		reqCtx.Warnf("Cannot write dial error response to mitm'd client: %v", err)
+	}
+}
+
+// releaseRemote hands a MITM upstream connection dialed by dialTls back to the
+// proxy ConnPool, or closes it when pooling is disabled.
+func releaseRemote(ctx *ProxyCtx, remote io.ReadWriteCloser, host string) {
+	uconn, ok := remote.(*tls.UConn)
+	if !ok || ctx.proxy.ConnPool == nil {
+		remote.Close()
+		return
+	}
+	ctx.proxy.ConnPool.Put(uconn, host)
+}
+
+// tunnelConns applies the TunnelIdle timeout to both ends of a MITM'd
+// connection that is being spliced with its upstream.
+func (proxy *ProxyHttpServer) tunnelConns(client net.Conn, remote io.ReadWriteCloser) (net.Conn, io.ReadWriteCloser) {
+	if conn, ok := remote.(net.Conn); ok {
+		remote = withIdleTimeout(conn, proxy.Timeouts.TunnelIdle)
+	}
+	return withIdleTimeout(client, proxy.Timeouts.TunnelIdle), remote
 }
 
 func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
-	msg := fmt.Sprintf("HTTP/1.1 500 Server error\r\n\r\n%v\r\n", err)
+	status := "500 Server error"
+	if code := errorStatus(err, 0); code != 0 {
+		status = strconv.Itoa(code) + " " + http.StatusText(code)
+	}
+	msg := fmt.Sprintf("HTTP/1.1 %s\r\n\r\n%v\r\n", status, err)
 	if _, err := io.WriteString(w, msg); err != nil {
 		ctx.Warnf("Error responding to client: %s", err)
 	}
@@ -456,19 +628,20 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 }
 
 func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
-	if _, err := io.Copy(dst, src); err != nil {
+	if _, err := io.Copy(dst, ctx.shapeReader(src)); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 	wg.Done()
 }
 
-func copyAndClose(ctx *ProxyCtx, dst, src halfClosable) {
-	if _, err := io.Copy(dst, src); err != nil {
+func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup) {
+	if _, err := io.Copy(dst, ctx.shapeReader(src)); err != nil {
 		ctx.Warnf("Error copying to client: %s", err)
 	}
 
 	dst.CloseWrite()
 	src.CloseRead()
+	wg.Done()
 }
 
 func dialerFromEnv(proxy *ProxyHttpServer) func(network, addr string) (net.Conn, error) {
@@ -486,93 +659,25 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(net
 	return proxy.NewConnectDialToProxyWithHandler(https_proxy, nil)
 }
 
+// NewConnectDialToProxyWithHandler returns a ConnectDial function tunneling
+// through the upstream proxy at https_proxy, an http, https, socks5, socks5h
+// or socks4a URL. HTTP proxies are sent a CONNECT request, which
+// connectReqHandler may modify, and a 407 is answered with the credentials
+// of the URL or of UpstreamCredentials. The dialer fails with an
+// UpstreamDialError when the upstream proxy cannot be reached, and with a
+// TunnelRefusedError when it refuses the tunnel. It returns nil, for
+// tunnels to be dialed directly, when https_proxy cannot be parsed or has
+// another scheme.
 func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy string, connectReqHandler func(req *http.Request)) func(network, addr string) (net.Conn, error) {
 	u, err := url.Parse(https_proxy)
 	if err != nil {
 		return nil
 	}
-	if u.Scheme == "" || u.Scheme == "http" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":80"
-		}
-		return func(network, addr string) (net.Conn, error) {
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				c.Close()
-				return nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				resp, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
-			}
-			return c, nil
-		}
-	}
-	if u.Scheme == "https" || u.Scheme == "wss" {
-		if strings.IndexRune(u.Host, ':') == -1 {
-			u.Host += ":443"
-		}
-		return func(network, addr string) (net.Conn, error) {
-			c, err := proxy.dial(network, u.Host)
-			if err != nil {
-				return nil, err
-			}
-			c = tls.Client(c, defaultTLSConfig)
-			connectReq := &http.Request{
-				Method: "CONNECT",
-				URL:    &url.URL{Opaque: addr},
-				Host:   addr,
-				Header: make(http.Header),
-			}
-			if connectReqHandler != nil {
-				connectReqHandler(connectReq)
-			}
-			connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
-			br := bufio.NewReader(c)
-			resp, err := http.ReadResponse(br, connectReq)
-			if err != nil {
-				c.Close()
-				return nil, err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
-				if err != nil {
-					return nil, err
-				}
-				c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
-			}
-			return c, nil
-		}
+	dial, err := proxy.newUpstreamDialer(u, connectReqHandler)
+	if err != nil {
+		return nil
 	}
-	return nil
+	return dial
 }
 
 func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
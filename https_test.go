@@ -0,0 +1,334 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func mitmClient(t *testing.T) (*http.Client, func()) {
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	srv := httptest.NewServer(proxy)
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	return client, srv.Close
+}
+
+func TestMitmDialsUpstreamWithClientALPN(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.Proto))
+	}))
+	defer upstream.Close()
+
+	client, done := mitmClient(t)
+	defer done()
+	resp, err := client.Get(upstream.URL)
+	orFatal("get", err, t)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	orFatal("read body", err, t)
+	if string(b) != "hello HTTP/1.1" {
+		t.Errorf("unexpected body %q", b)
+	}
+}
+
+func TestMitmReportsDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	addr := l.Addr().String()
+	l.Close()
+
+	client, done := mitmClient(t)
+	defer done()
+	resp, err := client.Get("https://" + addr + "/")
+	orFatal("get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 for unreachable upstream, got %d", resp.StatusCode)
+	}
+}
+
+func TestHostPortHelpers(t *testing.T) {
+	for _, c := range []struct {
+		addr, host string
+		port       bool
+	}{
+		{"example.com:443", "example.com", true},
+		{"example.com", "example.com", false},
+		{"[::1]:443", "::1", true},
+		{"[::1]", "::1", false},
+		{"::1", "::1", false},
+		{"2001:db8::1", "2001:db8::1", false},
+		{"[fe80::1%eth0]:80", "fe80::1%eth0", true},
+		{"10.0.0.1:8080", "10.0.0.1", true},
+	} {
+		if host := stripPort(c.addr); host != c.host {
+			t.Errorf("stripPort(%q) = %q, expected %q", c.addr, host, c.host)
+		}
+		if port := hasPort(c.addr); port != c.port {
+			t.Errorf("hasPort(%q) = %v, expected %v", c.addr, port, c.port)
+		}
+	}
+	if addr := withDefaultPort("::1", "443"); addr != "[::1]:443" {
+		t.Errorf("withDefaultPort(::1) = %q", addr)
+	}
+}
+
+func TestMitmRequestsShareTunnelCtx(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	type seen struct {
+		tunnel  *TunnelCtx
+		request int64
+		remote  string
+	}
+	requests := make(chan seen, 2)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		requests <- seen{ctx.Tunnel, ctx.TunnelRequest, req.RemoteAddr}
+		return req, nil
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "upstream.test", NextProtos: []string{"http/1.1"}},
+	}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(upstream.URL)
+		orFatal("get", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	first, second := <-requests, <-requests
+	if first.tunnel == nil || first.tunnel != second.tunnel {
+		t.Fatalf("expected both requests to share their tunnel, got %p and %p", first.tunnel, second.tunnel)
+	}
+	if first.request != 1 || second.request != 2 || first.tunnel.Requests() != 2 {
+		t.Errorf("expected requests 1 and 2 of the tunnel, got %d and %d", first.request, second.request)
+	}
+	tunnel := first.tunnel
+	if tunnel.Ctx.Req.Method != "CONNECT" || tunnel.ID != tunnel.Ctx.Session {
+		t.Errorf("expected the tunnel to reference the CONNECT context, got %s %d", tunnel.Ctx.Req.Method, tunnel.ID)
+	}
+	if tunnel.SNI != "upstream.test" || tunnel.ALPN != "http/1.1" || tunnel.Host != upstream.Listener.Addr().String() {
+		t.Errorf("unexpected tunnel %+v", tunnel)
+	}
+	if tunnel.ClientAddr == "" || first.remote != tunnel.ClientAddr {
+		t.Errorf("expected requests to carry the client address %q, got %q", tunnel.ClientAddr, first.remote)
+	}
+}
+
+func ipv6Listener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback not available:", err)
+	}
+	return l
+}
+
+// ipv6TLSServer serves body over TLS on the IPv6 loopback.
+func ipv6TLSServer(t *testing.T, body string) *httptest.Server {
+	s := &httptest.Server{Listener: ipv6Listener(t), Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})}}
+	s.StartTLS()
+	return s
+}
+
+func TestIPv6IsLocalHost(t *testing.T) {
+	for host, local := range map[string]bool{
+		"[::1]:8080":                true,
+		"::1":                       true,
+		"[::1]":                     true,
+		"[0:0:0:0:0:0:0:1]:443":     true,
+		"[::ffff:127.0.0.1]:80":     true,
+		"127.0.0.2:80":              true,
+		"localhost:80":              true,
+		"[2001:db8::1]:80":          false,
+		"[fe80::1]:443":             false,
+		"[::ffff:10.0.0.1]:80":      false,
+		"example.com:80":            false,
+		"[2001:db8::127.0.0.1]:443": false,
+	} {
+		req := &http.Request{URL: &url.URL{Host: host}}
+		if got := IsLocalHost.HandleReq(req, nil); got != local {
+			t.Errorf("IsLocalHost(%s) = %v, expected %v", host, got, local)
+		}
+	}
+}
+
+func TestIPv6HttpRequest(t *testing.T) {
+	s := &httptest.Server{Listener: ipv6Listener(t), Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v6")
+	})}}
+	s.Start()
+	defer s.Close()
+
+	srv := httptest.NewServer(NewProxyHttpServer())
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(s.URL + "/")
+	orFatal("get", err, t)
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	orFatal("read body", err, t)
+	if string(b) != "v6" {
+		t.Errorf("expected v6 through the proxy, got %q", b)
+	}
+}
+
+func TestIPv6Connect(t *testing.T) {
+	s := ipv6TLSServer(t, "v6tls")
+	defer s.Close()
+
+	for name, action := range map[string]*ConnectAction{
+		"accept": OkConnect,
+		"mitm":   MitmConnect,
+	} {
+		action := action
+		proxy := NewProxyHttpServer()
+		// randomized hellos fail now and then against crypto/tls servers
+		proxy.Fingerprints = NewFingerprintSelector()
+		proxy.Fingerprints.Pin(s.Listener.Addr().String(), "http/1.1", utls.HelloChrome_Auto)
+		proxy.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+			return action, host
+		})
+		srv := httptest.NewServer(proxy)
+		proxyURL, err := url.Parse(srv.URL)
+		orFatal("parse proxy url", err, t)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get(s.URL + "/")
+		orFatal(name+": get", err, t)
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		orFatal(name+": read body", err, t)
+		if string(b) != "v6tls" {
+			t.Errorf("%s: expected v6tls through CONNECT to %s, got %q", name, s.Listener.Addr(), b)
+		}
+		srv.Close()
+	}
+}
+
+func TestIPv6MitmCertificateHasIPSAN(t *testing.T) {
+	s := ipv6TLSServer(t, "v6tls")
+	defer s.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer c.Close()
+	host := s.Listener.Addr().String()
+	_, err = io.WriteString(c, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	orFatal("write CONNECT", err, t)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	orFatal("read CONNECT response", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT refused: %s", resp.Status)
+	}
+	ctls := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	orFatal("handshake with proxy", ctls.Handshake(), t)
+	cert := ctls.ConnectionState().PeerCertificates[0]
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("::1")) {
+		t.Errorf("expected MITM certificate for ::1, got IPs %v names %v", cert.IPAddresses, cert.DNSNames)
+	}
+}
+
+func TestMitmLeavesDefaultTLSConfigShared(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		return &ConnectAction{Action: ConnectMitm}, host
+	}))
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	// the tunnels have no certificate to serve, only the handshakes matter
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			if resp, err := client.Get(upstream.URL); err == nil {
+				resp.Body.Close()
+			}
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	if defaultTLSConfig.GetConfigForClient != nil || len(defaultTLSConfig.NextProtos) != 2 {
+		t.Error("expected the tunnels to leave defaultTLSConfig alone")
+	}
+}
+
+func TestMitmSharesConnPool(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	defer srv.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.ConnPool = NewConnPool()
+	defer proxy.ConnPool.Close()
+	proxy.Fingerprints = NewFingerprintSelector()
+	proxy.Fingerprints.Pin(srv.Listener.Addr().String(), "http/1.1", utls.HelloChrome_Auto)
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+	proxyURL, _ := url.Parse(proxySrv.URL)
+
+	for i := 0; i < 2; i++ {
+		// a new client makes a new tunnel
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get(srv.URL)
+		orFatal("get", err, t)
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "HTTP/1.1" {
+			t.Errorf("unexpected response %q", b)
+		}
+	}
+	proxy.ConnPool.mu.Lock()
+	n := len(proxy.ConnPool.transports)
+	proxy.ConnPool.mu.Unlock()
+	if n != 1 {
+		t.Errorf("expected the tunnels to share one transport, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// interimResponse is the informational response with the given status and
+// header received for req.
+func interimResponse(req *http.Request, code int, header http.Header) *http.Response {
+	return &http.Response{
+		Status:     strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// traceInterim returns req with a client trace passing the informational
+// responses received for it through the interim handlers, and those they
+// let through, except 100 Continue, to write. Informational responses are
+// only relayed to HTTP/1.1 clients.
+func (proxy *ProxyHttpServer) traceInterim(ctx *ProxyCtx, req *http.Request, write func(code int, header http.Header)) *http.Request {
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			resp := interimResponse(req, code, http.Header(header))
+			if proxy.filterInterim(resp, ctx) && code != http.StatusContinue && req.ProtoAtLeast(1, 1) {
+				write(code, resp.Header)
+			}
+			return nil
+		},
+	}))
+}
+
+// interimWriter sends informational responses through the ResponseWriter of
+// a request the proxy serves, until the final response. net/http sends the
+// 100 Continue a client expects on the first read of the request body,
+// racing with the other informational responses, so the writer sends it
+// instead, see expectContinue.
+type interimWriter struct {
+	w  http.ResponseWriter
+	mu sync.Mutex
+	// done is set once the final response is due
+	done bool
+}
+
+func (iw *interimWriter) write(code int, header http.Header) {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	if iw.done {
+		return
+	}
+	h := iw.w.Header()
+	for name, values := range header {
+		h[name] = values
+	}
+	iw.w.WriteHeader(code)
+	// the final response has headers of its own
+	for name := range header {
+		delete(h, name)
+	}
+}
+
+// finish stops the informational responses, before the final one.
+func (iw *interimWriter) finish() {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	iw.done = true
+}
+
+// expectContinue has the 100 Continue req expects sent through iw when the
+// body is first read, which keeps net/http from sending its own.
+func (iw *interimWriter) expectContinue(req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody || !req.ProtoAtLeast(1, 1) || !headerContains(req.Header, "Expect", "100-continue") {
+		return
+	}
+	req.Body = &continueBody{ReadCloser: req.Body, iw: iw}
+}
+
+type continueBody struct {
+	io.ReadCloser
+	iw   *interimWriter
+	once sync.Once
+}
+
+func (b *continueBody) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		b.iw.write(http.StatusContinue, nil)
+	})
+	return b.ReadCloser.Read(p)
+}
@@ -0,0 +1,133 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// earlyHintsServer sends 103 Early Hints before its final response.
+func earlyHintsServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		io.WriteString(w, "final")
+	}))
+}
+
+func expectEarlyHints(t *testing.T, r *bufio.Reader, req *http.Request) {
+	resp, err := http.ReadResponse(r, req)
+	orFatal("read interim response", err, t)
+	if resp.StatusCode != http.StatusEarlyHints || resp.Header.Get("Link") == "" || resp.Header.Get("X-Seen") != "yes" {
+		t.Fatalf("expected 103 Early Hints seen by the interim handler, got %s %v", resp.Status, resp.Header)
+	}
+	resp, body := readBody(t, r)
+	if resp.StatusCode != http.StatusOK || body != "final" || resp.Header.Get("Link") != "" {
+		t.Errorf("unexpected final response %s %v %q", resp.Status, resp.Header, body)
+	}
+}
+
+func markInterim(proxy *ProxyHttpServer) {
+	proxy.OnResponse().DoInterimFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		resp.Header.Set("X-Seen", "yes")
+		return true
+	})
+}
+
+func TestEarlyHintsRelayed(t *testing.T) {
+	upstream := earlyHintsServer()
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	markInterim(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	req, err := http.NewRequest("GET", upstream.URL+"/", nil)
+	orFatal("new request", err, t)
+	orFatal("write request", req.WriteProxy(conn), t)
+	expectEarlyHints(t, bufio.NewReader(conn), req)
+}
+
+func TestEarlyHintsRelayedThroughHTTPMitm(t *testing.T) {
+	upstream := earlyHintsServer()
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	conn, r, done := httpMitmTunnel(t, addr, markInterim)
+	defer done()
+	req, err := http.NewRequest("GET", "http://"+addr+"/", nil)
+	orFatal("new request", err, t)
+	orFatal("write request", req.Write(conn), t)
+	expectEarlyHints(t, r, req)
+}
+
+// holdBackBodies has the proxy send request bodies once the server asked
+// for them with 100 Continue.
+func holdBackBodies(proxy *ProxyHttpServer) {
+	proxy.Tr.ExpectContinueTimeout = time.Second
+}
+
+func TestHTTPMitmExpectationRefused(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// refuse without reading the body, net/http sends no 100 Continue
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	conn, r, done := httpMitmTunnel(t, addr, holdBackBodies)
+	defer done()
+	_, err := io.WriteString(conn, "PUT /upload HTTP/1.1\r\nHost: "+addr+"\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	orFatal("write request header", err, t)
+	resp, _ := readBody(t, r)
+	if resp.StatusCode != http.StatusUnauthorized || !resp.Close {
+		t.Errorf("expected the refusal without 100 Continue and a closing tunnel, got %s %v", resp.Status, resp.Header)
+	}
+}
+
+func TestEarlyHintsBeforeContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		// reading the body sends 100 Continue
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	markInterim(proxy)
+	holdBackBodies(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "PUT "+upstream.URL+"/upload HTTP/1.1\r\nHost: "+upstream.Listener.Addr().String()+"\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	orFatal("write request header", err, t)
+
+	r := bufio.NewReader(conn)
+	for _, code := range []int{http.StatusEarlyHints, http.StatusContinue} {
+		resp, err := http.ReadResponse(r, nil)
+		orFatal("read interim response", err, t)
+		if resp.StatusCode != code {
+			t.Fatalf("expected %d, got %s", code, resp.Status)
+		}
+	}
+	_, err = io.WriteString(conn, "hello")
+	orFatal("write request body", err, t)
+	resp, body := readBody(t, r)
+	if resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Errorf("unexpected final response %s %q", resp.Status, body)
+	}
+}
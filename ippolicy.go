@@ -0,0 +1,183 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// PrivateNetworks are the loopback, private, link-local and otherwise
+// non-routable networks that DenyPrivateNetworks blocks, including the
+// cloud metadata address 169.254.169.254.
+var PrivateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// IPPolicy decides which addresses the proxy may connect to. It is checked
+// against the addresses the Resolver returned, right before each dial the
+// proxy makes, so host names resolving to a forbidden network, including by
+// DNS rebinding after a condition looked at them, are caught.
+//
+// The proxy makes the dials of the Tr and ConnectDial that NewProxyHttpServer
+// sets up and of a ConnPool without Dial, and resolves the destinations of
+// socks5 upstream proxies itself. Dials left to a Tr, ConnPool.Dial or ConnectDial
+// of your own are not checked. Neither are the destinations of http, https,
+// socks5h and socks4a upstream proxies, which resolve them on their side:
+// only the upstream proxy is checked then, list it in Allow when it lives on
+// a denied network.
+type IPPolicy struct {
+	// Allow lists networks that may always be dialed, even when they are
+	// part of a denied network.
+	Allow []*net.IPNet
+	// Deny lists networks that may not be dialed.
+	Deny []*net.IPNet
+}
+
+// IPPolicyError is returned by dials the IPPolicy forbade.
+type IPPolicyError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *IPPolicyError) Error() string {
+	return fmt.Sprintf("access to %s (%s) is forbidden by the proxy", e.Host, e.IP)
+}
+
+// DenyPrivateNetworks returns an IPPolicy forbidding PrivateNetworks.
+func DenyPrivateNetworks() *IPPolicy {
+	p := &IPPolicy{}
+	if err := p.DenyCIDR(PrivateNetworks...); err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// AllowCIDR adds networks in CIDR notation to Allow.
+func (p *IPPolicy) AllowCIDR(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	p.Allow = append(p.Allow, nets...)
+	return nil
+}
+
+// DenyCIDR adds networks in CIDR notation to Deny.
+func (p *IPPolicy) DenyCIDR(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	p.Deny = append(p.Deny, nets...)
+	return nil
+}
+
+// Allowed reports whether ip may be dialed.
+func (p *IPPolicy) Allowed(ip net.IP) bool {
+	if containsIP(p.Allow, ip) {
+		return true
+	}
+	return !containsIP(p.Deny, ip)
+}
+
+// filter returns the addresses of host that may be dialed, or an
+// IPPolicyError naming the first one if none may.
+func (p *IPPolicy) filter(host string, addrs []net.IPAddr) ([]net.IPAddr, error) {
+	var allowed []net.IPAddr
+	for _, a := range addrs {
+		if p.Allowed(a.IP) {
+			allowed = append(allowed, a)
+		}
+	}
+	if len(allowed) == 0 && len(addrs) > 0 {
+		return nil, &IPPolicyError{Host: host, IP: addrs[0].IP}
+	}
+	return allowed, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// lookupDst resolves the destination host of req with the proxy Resolver.
+func (ctx *ProxyCtx) lookupDst(req *http.Request) []net.IP {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	host = stripPort(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	var resolver Resolver = net.DefaultResolver
+	lookupCtx := context.Background()
+	if ctx != nil && ctx.proxy != nil {
+		if ctx.proxy.Resolver != nil {
+			resolver = ctx.proxy.Resolver
+		}
+		if d := ctx.proxy.Timeouts.Dial; d > 0 {
+			var cancel context.CancelFunc
+			lookupCtx, cancel = context.WithTimeout(lookupCtx, d)
+			defer cancel()
+		}
+	}
+	addrs, err := resolver.LookupIPAddr(lookupCtx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// errorStatus is the status of the response reporting err to the client,
+// fallback unless the IPPolicy forbade the destination or an upstream proxy
+// failed.
+func errorStatus(err error, fallback int) int {
+	var policyErr *IPPolicyError
+	if errors.As(err, &policyErr) {
+		return http.StatusForbidden
+	}
+	var dialErr *UpstreamDialError
+	var refusedErr *TunnelRefusedError
+	if errors.As(err, &dialErr) || errors.As(err, &refusedErr) {
+		return http.StatusBadGateway
+	}
+	return fallback
+}
@@ -0,0 +1,119 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func policyProxy(t *testing.T) (*ProxyHttpServer, *httptest.Server, *http.Client) {
+	proxy := NewProxyHttpServer()
+	proxy.IPPolicy = DenyPrivateNetworks()
+	resolver := NewDNSResolver(nil)
+	resolver.AddHost("innocent.test", net.ParseIP("127.0.0.1"))
+	proxy.Resolver = resolver
+	srv := httptest.NewServer(proxy)
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	return proxy, srv, &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func TestIPPolicyBlocksResolvedPrivateAddress(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	proxy, srv, client := policyProxy(t)
+	defer srv.Close()
+	for _, u := range []string{upstream.URL, "http://innocent.test:" + port + "/"} {
+		resp, err := client.Get(u)
+		orFatal("get", err, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403 for %s, got %d", u, resp.StatusCode)
+		}
+	}
+
+	orFatal("allow", proxy.IPPolicy.AllowCIDR("127.0.0.1/32"), t)
+	resp, err := client.Get("http://innocent.test:" + port + "/")
+	orFatal("get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected allowed network to pass, got %d", resp.StatusCode)
+	}
+}
+
+func TestIPPolicyBlocksConnect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	defer target.Close()
+
+	_, srv, _ := policyProxy(t)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	host := target.Addr().String()
+	_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	orFatal("write CONNECT", err, t)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	orFatal("read CONNECT response", err, t)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for CONNECT to loopback, got %s", resp.Status)
+	}
+}
+
+func TestIPPolicyChecksOnlyUpstreamProxy(t *testing.T) {
+	upstreamProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxied "+r.URL.Host)
+	}))
+	defer upstreamProxy.Close()
+	upstreamURL, err := url.Parse(upstreamProxy.URL)
+	orFatal("parse upstream proxy url", err, t)
+
+	proxy, srv, client := policyProxy(t)
+	defer srv.Close()
+	proxy.Tr.Proxy = http.ProxyURL(upstreamURL)
+	resp, err := client.Get("http://10.9.8.7/")
+	orFatal("get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for the upstream proxy on the loopback, got %d", resp.StatusCode)
+	}
+
+	// the destination is left to the upstream proxy
+	orFatal("allow", proxy.IPPolicy.AllowCIDR("127.0.0.1/32"), t)
+	resp, err = client.Get("http://10.9.8.7/")
+	orFatal("get", err, t)
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	orFatal("read body", err, t)
+	if resp.StatusCode != http.StatusOK || string(b) != "proxied 10.9.8.7" {
+		t.Errorf("expected the upstream proxy to answer, got %d %q", resp.StatusCode, b)
+	}
+}
+
+func TestDstIsPrivate(t *testing.T) {
+	proxy, srv, _ := policyProxy(t)
+	srv.Close()
+	ctx := &ProxyCtx{proxy: proxy}
+	for host, private := range map[string]bool{
+		"innocent.test:80":     true,
+		"169.254.169.254":      true,
+		"[::1]:443":            true,
+		"10.1.2.3:8080":        true,
+		"93.184.216.34:80":     false,
+		"[2001:db8::1]:443":    false,
+		"[::ffff:10.0.0.1]:80": true,
+	} {
+		req := &http.Request{URL: &url.URL{Host: host}}
+		if got := DstIsPrivate(req, ctx); got != private {
+			t.Errorf("DstIsPrivate(%s) = %v, expected %v", host, got, private)
+		}
+	}
+}
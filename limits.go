@@ -0,0 +1,147 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnLimits caps the requests and CONNECT tunnels the proxy serves at the
+// same time. A zero value disables the corresponding cap.
+type ConnLimits struct {
+	// MaxConns caps all connections.
+	MaxConns int
+	// MaxConnsPerClient caps the connections of a single client IP.
+	MaxConnsPerClient int
+	// MaxConnsPerHost caps the connections to a single destination host.
+	MaxConnsPerHost int
+	// QueueTimeout is how long a connection exceeding a cap waits for a
+	// slot before it is rejected. If zero, it is rejected right away.
+	QueueTimeout time.Duration
+}
+
+// LimitScope tells which cap of ConnLimits was exceeded.
+type LimitScope string
+
+const (
+	LimitGlobal    LimitScope = "global"
+	LimitPerClient LimitScope = "client"
+	LimitPerHost   LimitScope = "host"
+)
+
+// LimitError is the error set on ProxyCtx.Error when a request is rejected
+// because of ConnLimits.
+type LimitError struct {
+	Scope LimitScope
+	// Key is the client IP or destination host, empty for LimitGlobal
+	Key   string
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	if e.Scope == LimitGlobal {
+		return fmt.Sprintf("too many connections (limit %d)", e.Limit)
+	}
+	return fmt.Sprintf("too many connections for %s %s (limit %d)", e.Scope, e.Key, e.Limit)
+}
+
+// StatusCode is the status of the response sent to rejected clients: 429
+// when the client itself exceeded its cap, 503 otherwise.
+func (e *LimitError) StatusCode() int {
+	if e.Scope == LimitPerClient {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+type connLimiter struct {
+	mu      sync.Mutex
+	total   int
+	clients map[string]int
+	hosts   map[string]int
+	// changed is closed and replaced whenever a slot is released
+	changed chan struct{}
+}
+
+// acquireConn takes a slot for a connection from the client of req to host,
+// waiting up to Limits.QueueTimeout for one to free up. The returned release
+// function must be called once the connection is done.
+func (proxy *ProxyHttpServer) acquireConn(req *http.Request, host string) (release func(), err *LimitError) {
+	limits := proxy.Limits
+	if limits.MaxConns <= 0 && limits.MaxConnsPerClient <= 0 && limits.MaxConnsPerHost <= 0 {
+		return func() {}, nil
+	}
+	client := stripPort(req.RemoteAddr)
+	host = stripPort(host)
+	l := &proxy.conns
+	var timeout <-chan time.Time
+	if limits.QueueTimeout > 0 {
+		timer := time.NewTimer(limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		limitErr, changed := l.tryAcquire(limits, client, host)
+		if limitErr == nil {
+			var once sync.Once
+			return func() { once.Do(func() { l.release(client, host) }) }, nil
+		}
+		if timeout == nil {
+			return nil, limitErr
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, limitErr
+		}
+	}
+}
+
+func (l *connLimiter) tryAcquire(limits ConnLimits, client, host string) (*LimitError, chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = make(map[string]int)
+		l.hosts = make(map[string]int)
+	}
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	switch {
+	case limits.MaxConns > 0 && l.total >= limits.MaxConns:
+		return &LimitError{Scope: LimitGlobal, Limit: limits.MaxConns}, l.changed
+	case limits.MaxConnsPerClient > 0 && l.clients[client] >= limits.MaxConnsPerClient:
+		return &LimitError{Scope: LimitPerClient, Key: client, Limit: limits.MaxConnsPerClient}, l.changed
+	case limits.MaxConnsPerHost > 0 && l.hosts[host] >= limits.MaxConnsPerHost:
+		return &LimitError{Scope: LimitPerHost, Key: host, Limit: limits.MaxConnsPerHost}, l.changed
+	}
+	l.total++
+	l.clients[client]++
+	l.hosts[host]++
+	return nil, nil
+}
+
+func (l *connLimiter) release(client, host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// limitResponse is the response sent to a client rejected because of err.
+func limitResponse(req *http.Request, err *LimitError) *http.Response {
+	resp := NewResponse(req, ContentTypeText, err.StatusCode(), err.Error())
+	resp.Header.Set("Retry-After", "1")
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	return resp
+}
@@ -0,0 +1,102 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPerClientLimitRejectsWith429(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-block
+	}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Limits.MaxConnsPerClient = 1
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, err := url.Parse(srv.URL)
+	orFatal("parse proxy url", err, t)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := client.Get(upstream.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	resp, err := client.Get(upstream.URL)
+	orFatal("get", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over the client limit, got %d", resp.StatusCode)
+	}
+	close(block)
+	<-done
+
+	resp, err = client.Get(upstream.URL)
+	orFatal("get after release", err, t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 once the slot was released, got %d", resp.StatusCode)
+	}
+}
+
+func TestGlobalLimitRejectsConnect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	proxy := NewProxyHttpServer()
+	proxy.Limits.MaxConns = 1
+	proxy.Limits.QueueTimeout = 50 * time.Millisecond
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	connect := func() (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		orFatal("dial proxy", err, t)
+		host := target.Addr().String()
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		orFatal("write CONNECT", err, t)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		orFatal("read CONNECT response", err, t)
+		return conn, resp
+	}
+
+	first, resp := connect()
+	defer first.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first CONNECT failed: %s", resp.Status)
+	}
+	second, resp := connect()
+	defer second.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 over the global limit, got %s", resp.Status)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+}
@@ -0,0 +1,400 @@
+package goproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mitmConn serves the HTTP/1.1 requests a client sends through a tunnel the
+// proxy intercepts, plain or TLS. Requests are read from a single buffered
+// reader and answered one at a time, in order, so pipelined requests keep
+// their order and no buffered byte is lost between them.
+type mitmConn struct {
+	proxy  *ProxyHttpServer
+	tunnel *TunnelCtx
+	conn   net.Conn
+	br     *bufio.Reader
+
+	// prepare completes a request read from the client, e.g. its URL,
+	// before the handlers see it.
+	prepare func(ctx *ProxyCtx, req *http.Request) error
+	// upgrade, if set, takes the connection over for requests switching
+	// to another protocol, such as websockets, and reports whether it did.
+	// It sees requests once the request handlers let them through.
+	upgrade func(ctx *ProxyCtx, req *http.Request) bool
+	// roundTrip sends a request upstream and returns the final response.
+	roundTrip func(ctx *ProxyCtx, req *http.Request) (*http.Response, error)
+
+	// wlock serializes writes to conn, interim responses may be written
+	// from the goroutines of the transport.
+	wlock sync.Mutex
+	// responded is set once the final response of the current request
+	// started, no interim response may follow. Guarded by wlock.
+	responded bool
+}
+
+func newMitmConn(proxy *ProxyHttpServer, tunnel *TunnelCtx, conn net.Conn) *mitmConn {
+	return &mitmConn{proxy: proxy, tunnel: tunnel, conn: conn, br: bufio.NewReader(conn)}
+}
+
+// serve answers requests until the client or the upstream server ends the
+// connection. The caller closes conn.
+func (c *mitmConn) serve() {
+	ctx := c.tunnel.Ctx
+	for c.proxy.awaitRequest(ctx, c.conn, c.br) {
+		req, err := http.ReadRequest(c.br)
+		c.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if err != io.EOF {
+				ctx.Warnf("Cannot read request from mitm'd client %v: %v", c.tunnel.Host, err)
+			}
+			return
+		}
+		// since we're converting the request, need to carry over the
+		// original connecting IP as well
+		req.RemoteAddr = c.tunnel.ClientAddr
+		reqCtx := c.tunnel.newCtx(req)
+		if c.prepare != nil {
+			if err := c.prepare(reqCtx, req); err != nil {
+				reqCtx.Warnf("Illegal request %v: %v", req.URL, err)
+				return
+			}
+		}
+		if !c.serveRequest(reqCtx, req) {
+			return
+		}
+	}
+	ctx.Logf("Exiting on EOF")
+}
+
+// serveRequest answers req and reports whether the connection may carry
+// another request.
+func (c *mitmConn) serveRequest(ctx *ProxyCtx, req *http.Request) bool {
+	c.wlock.Lock()
+	c.responded = false
+	c.wlock.Unlock()
+
+	// the body read from the client, whatever handlers replace it with
+	clientBody := req.Body
+	var expect *expectContinueReader
+	if req.ProtoAtLeast(1, 1) && strings.EqualFold(req.Header.Get("Expect"), "100-continue") && req.ContentLength != 0 {
+		// the client waits for a 100 Continue before sending the body,
+		// send it once somebody reads the body
+		expect = &expectContinueReader{ReadCloser: req.Body, conn: c}
+		req.Body = expect
+		clientBody = expect
+	}
+	req = c.proxy.traceInterim(ctx, req, c.writeInterim)
+	ctx.Req = req
+
+	req, resp := c.proxy.filterRequest(req, ctx)
+	if resp == nil && c.upgrade != nil && c.upgrade(ctx, req) {
+		// the connection now carries the protocol switched to
+		return false
+	}
+	// the body of the upstream response, its length holds unless a
+	// handler replaces it
+	var upstreamResp *http.Response
+	var upstreamBody io.ReadCloser
+	if resp == nil {
+		var err error
+		if resp, err = c.roundTrip(ctx, req); err != nil {
+			ctx.Warnf("Cannot read response from mitm'd server %v: %v", c.tunnel.Host, err)
+			httpError(c.conn, ctx, err)
+			return false
+		}
+		ctx.Logf("resp %v", resp.Status)
+		upstreamResp, upstreamBody = resp, resp.Body
+	}
+	resp = c.proxy.filterResponse(resp, ctx)
+	defer resp.Body.Close()
+
+	keepAlive := req.ProtoAtLeast(1, 1) && !req.Close && !resp.Close
+	if expect != nil && !expect.sent() {
+		// the client may or may not send the body it was not asked for,
+		// the connection cannot be reused
+		keepAlive = false
+	}
+	knownLength := resp != upstreamResp || unwrapBody(resp.Body) == upstreamBody
+	keepAlive, err := c.writeResponse(ctx, req, resp, knownLength, keepAlive)
+	if err != nil {
+		ctx.Warnf("Cannot write response to mitm'd client: %v", err)
+		return false
+	}
+	if !keepAlive {
+		return false
+	}
+	// skip what remains of the request body, the next request follows it
+	if err := clientBody.Close(); err != nil {
+		ctx.Warnf("Cannot discard request body of mitm'd client: %v", err)
+		return false
+	}
+	return true
+}
+
+// unwrapBody returns the body body reads from, through the bodies that
+// only observe the one they wrap, such as the ones of a HARRecorder.
+func unwrapBody(body io.ReadCloser) io.ReadCloser {
+	for {
+		w, ok := body.(interface{ unwrapBody() io.ReadCloser })
+		if !ok {
+			return body
+		}
+		body = w.unwrapBody()
+	}
+}
+
+// writeInterim sends the client an informational (1xx) response, unless
+// the final response already started.
+func (c *mitmConn) writeInterim(code int, header http.Header) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.responded {
+		return
+	}
+	fmt.Fprintf(c.conn, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	header.Write(c.conn)
+	io.WriteString(c.conn, "\r\n")
+}
+
+// writeResponse writes the final response to the client, see
+// writeHijackedResponse.
+func (c *mitmConn) writeResponse(ctx *ProxyCtx, req *http.Request, resp *http.Response, knownLength, keepAlive bool) (bool, error) {
+	c.wlock.Lock()
+	c.responded = true
+	c.wlock.Unlock()
+	return writeHijackedResponse(c.conn, req, resp, ctx.shapeReader(resp.Body), knownLength, keepAlive, c.proxy.flushLatency(resp, ctx))
+}
+
+// expectContinueReader sends the client 100 Continue before the first read
+// of a request body the client holds back until then.
+type expectContinueReader struct {
+	io.ReadCloser
+	conn *mitmConn
+
+	once    sync.Once
+	writeOK bool
+}
+
+func (r *expectContinueReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.conn.wlock.Lock()
+		defer r.conn.wlock.Unlock()
+		if !r.conn.responded {
+			_, err := io.WriteString(r.conn.conn, "HTTP/1.1 100 Continue\r\n\r\n")
+			r.writeOK = err == nil
+		}
+	})
+	if !r.writeOK {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// Close leaves a body the client was not asked for alone, there is nothing
+// to skip.
+func (r *expectContinueReader) Close() error {
+	if !r.sent() {
+		return nil
+	}
+	return r.ReadCloser.Close()
+}
+
+// sent reports whether the client was told to send the body.
+func (r *expectContinueReader) sent() bool {
+	r.once.Do(func() {})
+	return r.writeOK
+}
+
+// bufferedConn reads a connection through the reader buffering it, so that
+// whoever takes over a mitmConn does not lose what was read ahead.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// clientConn returns the client connection for upgrades taking it over.
+func (c *mitmConn) clientConn() net.Conn {
+	return &bufferedConn{Conn: c.conn, r: c.br}
+}
+
+// plainUpstream is the persistent connection to the server of a plain HTTP
+// tunnel, redialed whenever the server closed it.
+type plainUpstream struct {
+	dial func() (net.Conn, error)
+	// expectContinueTimeout is how long a request with Expect:
+	// 100-continue waits for the server to ask for its body, it is sent
+	// right away if zero
+	expectContinueTimeout time.Duration
+
+	conn net.Conn
+	br   *bufio.Reader
+	// body is the body of the last response, it must be read to its end
+	// before the next response can be
+	body io.Closer
+}
+
+// roundTrip writes req to the server and reads its final response, passing
+// informational responses to the Got1xxResponse hook of the request.
+func (u *plainUpstream) roundTrip(req *http.Request) (*http.Response, error) {
+	if u.body != nil {
+		// handlers may have replaced the last response without reading it,
+		// closing drains it
+		u.body.Close()
+		u.body = nil
+	}
+	if u.conn == nil {
+		conn, err := u.dial()
+		if err != nil {
+			return nil, err
+		}
+		u.conn, u.br = conn, bufio.NewReader(conn)
+	}
+	bw := bufio.NewWriter(u.conn)
+	var gate *continueGate
+	if u.expectContinueTimeout > 0 && req.ContentLength != 0 && strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		gate = &continueGate{ReadCloser: req.Body, u: u, req: req, bw: bw}
+		req.Body = gate
+	}
+	err := req.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if gate != nil {
+		req.Body = gate.ReadCloser
+		if gate.final != nil {
+			// the server answered without the body, which was cut short,
+			// the connection cannot be reused
+			return u.closing(gate.final), nil
+		}
+	}
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	resp, err := u.readResponse(req, false)
+	if err != nil {
+		u.close()
+		return nil, err
+	}
+	if resp.Close {
+		return u.closing(resp), nil
+	}
+	u.body = resp.Body
+	return resp, nil
+}
+
+// readResponse reads the final response to req, or the 100 Continue
+// preceding it if untilContinue is set.
+func (u *plainUpstream) readResponse(req *http.Request, untilContinue bool) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(u.br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.Got1xxResponse != nil {
+			trace.Got1xxResponse(resp.StatusCode, textproto.MIMEHeader(resp.Header))
+		}
+		if untilContinue && resp.StatusCode == http.StatusContinue {
+			return resp, nil
+		}
+	}
+}
+
+// awaitContinue waits for the server to ask for the body of req. It returns
+// the final response if the server answered without asking, and nothing if
+// the server did not answer within expectContinueTimeout.
+func (u *plainUpstream) awaitContinue(req *http.Request) (*http.Response, error) {
+	u.conn.SetReadDeadline(time.Now().Add(u.expectContinueTimeout))
+	_, err := u.br.Peek(1)
+	u.conn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.readResponse(req, true)
+	if err != nil || resp.StatusCode == http.StatusContinue {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// closing makes resp close the connection along with its body.
+func (u *plainUpstream) closing(resp *http.Response) *http.Response {
+	resp.Close = true
+	resp.Body = &closeAfterBody{ReadCloser: resp.Body, u: u, conn: u.conn}
+	u.body = resp.Body
+	return resp
+}
+
+// continueGate holds the body of a request with Expect: 100-continue back
+// until the server asked for it.
+type continueGate struct {
+	io.ReadCloser
+	u   *plainUpstream
+	req *http.Request
+	bw  *bufio.Writer
+
+	asked bool
+	// final is the response the server sent instead of 100 Continue
+	final *http.Response
+}
+
+func (g *continueGate) Read(p []byte) (int, error) {
+	if !g.asked {
+		g.asked = true
+		// the request header may still be buffered
+		if err := g.bw.Flush(); err != nil {
+			return 0, err
+		}
+		resp, err := g.u.awaitContinue(g.req)
+		if err != nil {
+			return 0, err
+		}
+		g.final = resp
+	}
+	if g.final != nil {
+		return 0, io.EOF
+	}
+	return g.ReadCloser.Read(p)
+}
+
+func (u *plainUpstream) close() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn, u.br, u.body = nil, nil, nil
+	}
+}
+
+// closeAfterBody closes the upstream connection along with the body of its
+// last response.
+type closeAfterBody struct {
+	io.ReadCloser
+	u    *plainUpstream
+	conn net.Conn
+}
+
+func (b *closeAfterBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.u.conn == b.conn {
+		b.u.close()
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// echoServer answers every request with its method, path and body and
+// counts the connections it accepted.
+func echoServer(conns *int32) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(b))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	srv.Start()
+	return srv
+}
+
+// httpMitmTunnel opens a CONNECT tunnel to addr through a proxy MITMing
+// plain HTTP, set up by setup.
+func httpMitmTunnel(t *testing.T, addr string, setup ...func(proxy *ProxyHttpServer)) (net.Conn, *bufio.Reader, func()) {
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		return HTTPMitmConnect, host
+	}))
+	for _, f := range setup {
+		f(proxy)
+	}
+	srv := httptest.NewServer(proxy)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	_, err = io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	orFatal("write CONNECT", err, t)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("read CONNECT response", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT refused: %s", resp.Status)
+	}
+	return conn, r, func() {
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func readBody(t *testing.T, r *bufio.Reader) (*http.Response, string) {
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("read response", err, t)
+	b, err := ioutil.ReadAll(resp.Body)
+	orFatal("read body", err, t)
+	return resp, string(b)
+}
+
+func TestHTTPMitmPipelining(t *testing.T) {
+	var conns int32
+	upstream := echoServer(&conns)
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	conn, r, done := httpMitmTunnel(t, addr)
+	defer done()
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: "+addr+"\r\n\r\n"+
+		"POST /two HTTP/1.1\r\nHost: "+addr+"\r\nContent-Length: 4\r\n\r\nbody"+
+		"GET /three HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	orFatal("write requests", err, t)
+	for _, expected := range []string{"GET /one ", "POST /two body", "GET /three "} {
+		resp, body := readBody(t, r)
+		if body != expected {
+			t.Errorf("expected %q, got %q", expected, body)
+		}
+		if resp.Close {
+			t.Errorf("expected the tunnel to stay open after %q", expected)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected the requests to share one upstream connection, got %d", n)
+	}
+}
+
+func TestHTTPMitmConnectionClose(t *testing.T) {
+	var conns int32
+	upstream := echoServer(&conns)
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	conn, r, done := httpMitmTunnel(t, addr)
+	defer done()
+	_, err := io.WriteString(conn, "GET /last HTTP/1.1\r\nHost: "+addr+"\r\nConnection: close\r\n\r\n"+
+		"GET /ignored HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	orFatal("write requests", err, t)
+	resp, body := readBody(t, r)
+	if body != "GET /last " || !resp.Close {
+		t.Errorf("expected the response to close the tunnel, got %q %v", body, resp.Header)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected the tunnel to be closed, got %v", err)
+	}
+}
+
+func TestHTTPMitmExpectContinue(t *testing.T) {
+	var conns int32
+	upstream := echoServer(&conns)
+	defer upstream.Close()
+	addr := upstream.Listener.Addr().String()
+
+	conn, r, done := httpMitmTunnel(t, addr)
+	defer done()
+	_, err := io.WriteString(conn, "PUT /upload HTTP/1.1\r\nHost: "+addr+"\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	orFatal("write request header", err, t)
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("read interim response", err, t)
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("expected 100 Continue before the body, got %s", resp.Status)
+	}
+	_, err = io.WriteString(conn, "hello")
+	orFatal("write request body", err, t)
+	if _, body := readBody(t, r); body != "PUT /upload hello" {
+		t.Errorf("unexpected response %q", body)
+	}
+
+	_, err = io.WriteString(conn, "GET /next HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	orFatal("write next request", err, t)
+	if _, body := readBody(t, r); body != "GET /next " {
+		t.Errorf("expected the tunnel to carry on, got %q", body)
+	}
+}
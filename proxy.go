@@ -1,14 +1,13 @@
 package goproxy
 
 import (
-	"bufio"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"regexp"
 	"sync/atomic"
+	"time"
 
 	tls "github.com/refraction-networking/utls"
 )
@@ -27,16 +26,84 @@ type ProxyHttpServer struct {
 	Http2Handler    func(r *http.Request, rawClientTls *tls.Conn, remote *tls.UConn) bool
 	reqHandlers     []ReqHandler
 	respHandlers    []RespHandler
+	interimHandlers []InterimRespHandler
 	httpsHandlers   []HttpsHandler
-	Tr              *http.Transport
+	// Tr sends the requests of clients upstream. With its
+	// ExpectContinueTimeout set, the bodies of requests expecting
+	// 100 Continue are held back until the server asked for them, and the
+	// client gets its 100 Continue once they are read.
+	Tr *http.Transport
 	// ConnectDial will be used to create TCP connections for CONNECT requests
 	// if nil Tr.Dial will be used
 	ConnectDial func(network string, addr string) (net.Conn, error)
-	CertStore   CertStorage
+	// UpstreamCredentials, if set, supplies the credentials answering the
+	// challenge of an upstream proxy of NewConnectDialToProxy whose URL has
+	// none
+	UpstreamCredentials UpstreamCredentials
+	// Auth, if set, requires clients to authenticate before their requests
+	// and CONNECTs are handled
+	Auth      *ProxyAuth
+	CertStore CertStorage
+	// SessionCache keeps upstream TLS sessions so that uTLS and websocket dials
+	// can resume them, e.g. NewSessionCache(DefaultSessionCacheSize). If nil
+	// every upstream dial does a full handshake.
+	SessionCache *SessionCache
+	// ConnPool shares upstream MITM connections between client sessions,
+	// e.g. NewConnPool(). If nil every CONNECT dials its own upstream
+	// connections.
+	ConnPool *ConnPool
+	// Fingerprints chooses the ClientHelloID of MITM upstream handshakes
+	// and remembers which one each host accepts, e.g.
+	// NewFingerprintSelector(DefaultFingerprints...). If nil only the
+	// default fingerprint is tried.
+	Fingerprints *FingerprintSelector
+	// WebsocketTLSConfig configures the TLS client of the upstream
+	// connections of websockets and other protocol upgrades, e.g. the roots
+	// to verify servers with. If nil servers are verified against the
+	// system roots, except in MITM'd tunnels, which verify them as their
+	// TLS config does.
+	WebsocketTLSConfig *tls.Config
+	// Timeouts bounds dials, handshakes and idle periods of hijacked
+	// connections, e.g. DefaultTimeouts. The zero value sets no timeout.
+	Timeouts Timeouts
+	// Bandwidth holds the token buckets of requests and tunnels limited
+	// with ProxyCtx.Throttle, e.g. NewBandwidthShaper(). If nil no traffic
+	// is throttled.
+	Bandwidth *BandwidthShaper
+	// Limits caps concurrent requests and CONNECT tunnels. Requests over a
+	// cap get a 429 or 503 response.
+	Limits ConnLimits
+	conns  connLimiter
+	// Resolver resolves the host names of every upstream connection,
+	// including the ones dialed by the Tr NewProxyHttpServer sets up and by
+	// a ConnPool without a Dial of its own. If nil the system resolver is used without
+	// caching, set it to a DNSResolver to cache answers or to resolve over
+	// TLS or HTTPS.
+	Resolver Resolver
+	// IPPolicy restricts the addresses upstream connections may go to,
+	// requests to forbidden addresses get a 403 response. See IPPolicy for
+	// the dials it covers. If nil any address may be dialed.
+	IPPolicy *IPPolicy
+	// FlushInterval bounds how long a response body written to the client
+	// may stay buffered. Zero flushes when buffers fill up and once the
+	// body ended, a negative value after every write. The bodies of
+	// streaming responses, see StreamingContentTypes, are always flushed
+	// after every write.
+	FlushInterval time.Duration
+	// StreamingContentTypes lists the media types, such as server-sent
+	// events, whose responses are streaming. So are responses of unknown
+	// length and the ones handlers set ProxyCtx.StreamResponse for.
+	StreamingContentTypes []string
+	// TunnelMethods lists the request methods, such as the ones of Remote
+	// Desktop Gateway, whose connection turns into a raw stream once the
+	// request is sent, see UpgradeStream.
+	TunnelMethods []string
+	// websocketHandlers see the messages of websockets, which are spliced
+	// without parsing when there are none
+	websocketHandlers []WebsocketHandler
+	upgradeHandlers   []UpgradeHandler
 }
 
-var hasPort = regexp.MustCompile(`:\d+$`)
-
 func copyHeaders(dst, src http.Header, keepDestHeaders bool) {
 	if !keepDestHeaders {
 		for k := range dst {
@@ -50,14 +117,6 @@ func copyHeaders(dst, src http.Header, keepDestHeaders bool) {
 	}
 }
 
-func isEof(r *bufio.Reader) bool {
-	_, err := r.Peek(1)
-	if err == io.EOF {
-		return true
-	}
-	return false
-}
-
 func (proxy *ProxyHttpServer) FilterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	return proxy.filterRequest(r, ctx)
 }
@@ -72,6 +131,7 @@ func (proxy *ProxyHttpServer) ResetReqHandlers() {
 
 func (proxy *ProxyHttpServer) ResetRespHandlers() {
 	proxy.respHandlers = []RespHandler{}
+	proxy.interimHandlers = nil
 }
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
@@ -95,6 +155,39 @@ func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *Proxy
 	return
 }
 
+// filterInterim passes an informational response through the interim
+// handlers and reports whether it should reach the client.
+func (proxy *ProxyHttpServer) filterInterim(resp *http.Response, ctx *ProxyCtx) bool {
+	for _, h := range proxy.interimHandlers {
+		if !h.HandleInterim(resp, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterWebsocket passes a websocket message through the websocket handlers
+// and returns the messages to send in its place.
+func (proxy *ProxyHttpServer) filterWebsocket(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage {
+	msgs := []*WebsocketMessage{msg}
+	for _, h := range proxy.websocketHandlers {
+		var filtered []*WebsocketMessage
+		for _, m := range msgs {
+			filtered = append(filtered, h.HandleMessage(m, ctx)...)
+		}
+		msgs = filtered
+	}
+	return msgs
+}
+
+// filterUpgrade passes a stream switched to another protocol through the
+// upgrade handlers.
+func (proxy *ProxyHttpServer) filterUpgrade(s *UpgradeStream, ctx *ProxyCtx) {
+	for _, h := range proxy.upgradeHandlers {
+		h.HandleUpgrade(s, ctx)
+	}
+}
+
 func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 	r.RequestURI = ""
 }
@@ -113,16 +206,35 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			proxy.NonproxyHandler.ServeHTTP(w, r)
 			return
 		}
-		r, resp := proxy.filterRequest(r, ctx)
+		if authResp := proxy.checkProxyAuth(r, ctx); authResp != nil {
+			copyHeaders(w.Header(), authResp.Header, false)
+			w.WriteHeader(authResp.StatusCode)
+			io.Copy(w, authResp.Body)
+			return
+		}
+		var resp *http.Response
+		release, limitErr := proxy.acquireConn(r, r.URL.Host)
+		if limitErr != nil {
+			ctx.Warnf("Rejecting request to %v: %v", r.URL.Host, limitErr)
+			ctx.Error = limitErr
+			resp = limitResponse(r, limitErr)
+		} else {
+			defer release()
+			r, resp = proxy.filterRequest(r, ctx)
+		}
 
 		if resp == nil {
-			if isWebSocketRequest(r) {
-				ctx.Logf("Request looks like websocket upgrade.")
-				proxy.serveWebsocket(ctx, w, r)
+			if proxy.isUpgradeRequest(r) {
+				ctx.Logf("Request looks like protocol upgrade.")
+				proxy.serveUpgrade(ctx, w, r)
+				return
 			}
 
 			removeProxyHeaders(ctx, r)
-			resp, err = ctx.RoundTrip(r)
+			interim := &interimWriter{w: w}
+			interim.expectContinue(r)
+			resp, err = ctx.RoundTrip(proxy.traceInterim(ctx, r, interim.write))
+			interim.finish()
 			if err != nil {
 				ctx.Error = err
 				resp = proxy.filterResponse(nil, ctx)
@@ -139,7 +251,7 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			if ctx.Error != nil {
 				errorString = "error read response " + r.URL.Host + " : " + ctx.Error.Error()
 				ctx.Logf(errorString)
-				http.Error(w, ctx.Error.Error(), 500)
+				http.Error(w, ctx.Error.Error(), errorStatus(ctx.Error, 500))
 			} else {
 				errorString = "error read response " + r.URL.Host
 				ctx.Logf(errorString)
@@ -161,7 +273,7 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
 		w.WriteHeader(resp.StatusCode)
-		nr, err := io.Copy(w, resp.Body)
+		nr, err := copyResponseBody(w, ctx.shapeReader(resp.Body), proxy.flushLatency(resp, ctx))
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("Can't close response body %v", err)
 		}
@@ -180,7 +292,18 @@ func NewProxyHttpServer() *ProxyHttpServer {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 		}),
 		Tr: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		StreamingContentTypes: []string{
+			"text/event-stream",
+			"application/grpc-web",
+			"application/grpc-web+proto",
+			"application/grpc-web-text",
+			"application/grpc-web-text+proto",
+			"application/x-ndjson",
+		},
+		// Remote Desktop Gateway
+		TunnelMethods: []string{"RDG_IN_DATA", "RDG_OUT_DATA"},
 	}
+	proxy.Tr.DialContext = proxy.dialContext
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 
 	return &proxy
@@ -0,0 +1,559 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDNSTTL is how long DNSResolver caches the answers of the system
+// resolver, whose TTL is unknown. Static overrides never expire.
+const DefaultDNSTTL = 30 * time.Second
+
+// DefaultDNSCacheSize is the number of host names a DNSResolver returned by
+// NewDNSResolver caches.
+const DefaultDNSCacheSize = 4096
+
+// Resolver resolves the host names of every connection the proxy dials.
+// *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DNSTransport sends a packed DNS query to an upstream server and returns
+// the packed response.
+type DNSTransport interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// DNSResolver is a caching Resolver. Host names are looked up in static
+// overrides first, then in the cache, and finally sent to Transport. Answers
+// are cached for the smallest TTL of their A and AAAA records.
+type DNSResolver struct {
+	// Transport sends queries upstream. If nil, the system resolver is
+	// used and its answers are cached for DefaultDNSTTL.
+	Transport DNSTransport
+	// MinTTL and MaxTTL clamp the time answers are cached, zero means no
+	// bound.
+	MinTTL, MaxTTL time.Duration
+	// MaxEntries caps the host names cached. Once it is reached, expired
+	// answers are dropped and then the ones expiring first. Zero means no
+	// cap.
+	MaxEntries int
+
+	mu    sync.Mutex
+	hosts map[string][]net.IPAddr
+	cache map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// NewDNSResolver returns a DNSResolver querying transport, or the system
+// resolver if transport is nil.
+func NewDNSResolver(transport DNSTransport) *DNSResolver {
+	return &DNSResolver{
+		Transport:  transport,
+		MaxEntries: DefaultDNSCacheSize,
+		hosts:      make(map[string][]net.IPAddr),
+		cache:      make(map[string]*dnsCacheEntry),
+	}
+}
+
+// AddHost makes host resolve to ips without asking upstream. Without ips the
+// override for host is removed.
+func (r *DNSResolver) AddHost(host string, ips ...net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	host = dnsKey(host)
+	if len(ips) == 0 {
+		delete(r.hosts, host)
+		return
+	}
+	if r.hosts == nil {
+		r.hosts = make(map[string][]net.IPAddr)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	r.hosts[host] = addrs
+}
+
+// LoadHosts adds the overrides of a hosts file, each line holding an address
+// followed by host names.
+func (r *DNSResolver) LoadHosts(hosts io.Reader) error {
+	overrides := make(map[string][]net.IP)
+	var order []string
+	scanner := bufio.NewScanner(hosts)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return fmt.Errorf("invalid address %q in hosts file", fields[0])
+		}
+		for _, host := range fields[1:] {
+			if _, ok := overrides[host]; !ok {
+				order = append(order, host)
+			}
+			overrides[host] = append(overrides[host], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, host := range order {
+		r.AddHost(host, overrides[host]...)
+	}
+	return nil
+}
+
+// Flush empties the cache, static overrides are kept.
+func (r *DNSResolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[string]*dnsCacheEntry)
+}
+
+// LookupIPAddr implements Resolver.
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	key := dnsKey(host)
+	r.mu.Lock()
+	if addrs, ok := r.hosts[key]; ok {
+		r.mu.Unlock()
+		return addrs, nil
+	}
+	if entry, ok := r.cache[key]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		return entry.addrs, nil
+	}
+	r.mu.Unlock()
+
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	var err error
+	if r.Transport == nil {
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+		ttl = DefaultDNSTTL
+	} else {
+		addrs, ttl, err = r.query(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.MinTTL > 0 && ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	if ttl > 0 {
+		r.mu.Lock()
+		if r.cache == nil {
+			r.cache = make(map[string]*dnsCacheEntry)
+		}
+		if _, ok := r.cache[key]; !ok && r.MaxEntries > 0 && len(r.cache) >= r.MaxEntries {
+			r.evict()
+		}
+		r.cache[key] = &dnsCacheEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+// evict makes room for an answer in the full cache, dropping the expired
+// answers or else the one expiring first. The caller holds the lock.
+func (r *DNSResolver) evict() {
+	now := time.Now()
+	var first string
+	var firstExpires time.Time
+	for key, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, key)
+			continue
+		}
+		if first == "" || entry.expires.Before(firstExpires) {
+			first, firstExpires = key, entry.expires
+		}
+	}
+	if len(r.cache) >= r.MaxEntries {
+		delete(r.cache, first)
+	}
+}
+
+// query asks Transport for the A and AAAA records of host.
+func (r *DNSResolver) query(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	name, err := dnsmessage.NewName(dnsKey(host))
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	type answer struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, typ := range types {
+		wg.Add(1)
+		go func(i int, typ dnsmessage.Type) {
+			defer wg.Done()
+			a := &answers[i]
+			a.addrs, a.ttl, a.err = r.exchange(ctx, name, typ)
+		}(i, typ)
+	}
+	wg.Wait()
+
+	var addrs []net.IPAddr
+	var ttl time.Duration = -1
+	var lastErr error
+	for _, a := range answers {
+		if a.err != nil {
+			lastErr = a.err
+			continue
+		}
+		if len(a.addrs) > 0 && (ttl < 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+		addrs = append(addrs, a.addrs...)
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, 0, lastErr
+	}
+	return addrs, ttl, nil
+}
+
+func (r *DNSResolver) exchange(ctx context.Context, name dnsmessage.Name, typ dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	// an unpredictable ID makes spoofing answers over UDP harder
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	question := dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := r.Transport.Exchange(ctx, query)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(), IsTemporary: true}
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, 0, &net.DNSError{Err: "cannot parse DNS response: " + err.Error(), Name: name.String()}
+	}
+	if resp.Header.ID != id {
+		return nil, 0, &net.DNSError{Err: "DNS response ID mismatch", Name: name.String()}
+	}
+	if !resp.Header.Response || len(resp.Questions) != 1 || !sameQuestion(resp.Questions[0], question) {
+		return nil, 0, &net.DNSError{Err: "DNS response does not answer the question", Name: name.String()}
+	}
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name.String(), IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "DNS server failure: " + resp.Header.RCode.String(), Name: name.String(), IsTemporary: true}
+	}
+
+	var addrs []net.IPAddr
+	var ttl uint32
+	for _, rr := range resp.Answers {
+		var ip net.IP
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		if len(addrs) == 0 || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// sameQuestion reports whether a and b ask for the same records, names are
+// compared case-insensitively.
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+func dnsKey(host string) string {
+	host = strings.ToLower(host)
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	return host
+}
+
+// DNSOverUDP returns a DNSTransport querying the DNS server at addr over
+// UDP, retrying over TCP when the answer was truncated.
+func DNSOverUDP(addr string) DNSTransport {
+	return &udpTransport{addr: addr}
+}
+
+// DNSOverTLS returns a DNSTransport querying the DNS-over-TLS server at addr.
+// config may be nil, its ServerName defaults to the host of addr.
+func DNSOverTLS(addr string, config *tls.Config) DNSTransport {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = stripPort(addr)
+	}
+	return &tlsTransport{addr: addr, config: config}
+}
+
+// DNSOverHTTPS returns a DNSTransport posting queries to the DNS-over-HTTPS
+// endpoint url. If client is nil, http.DefaultClient is used.
+func DNSOverHTTPS(url string, client *http.Client) DNSTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpsTransport{url: url, client: client}
+}
+
+type udpTransport struct {
+	addr string
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	var h dnsmessage.Header
+	var p dnsmessage.Parser
+	if h, err = p.Start(buf[:n]); err == nil && h.Truncated {
+		tcp, err := d.DialContext(ctx, "tcp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		defer tcp.Close()
+		return exchangeStream(ctx, tcp, query)
+	}
+	return buf[:n], nil
+}
+
+type tlsTransport struct {
+	addr   string
+	config *tls.Config
+}
+
+func (t *tlsTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, t.config)
+	defer conn.Close()
+	return exchangeStream(ctx, conn, query)
+}
+
+// exchangeStream sends query over a stream connection, each message being
+// prefixed with its two byte length.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpsTransport) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned %q", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// resolvedConn is a connection made by dialContext, it carries the addresses
+// the host resolved to until a round trip picks it up, see recordRoundTrip.
+type resolvedConn struct {
+	net.Conn
+	ips []net.IP
+}
+
+// resolvedIPs returns the addresses recorded on conn or on the connection it
+// wraps, if any.
+func resolvedIPs(conn net.Conn) []net.IP {
+	for {
+		switch c := conn.(type) {
+		case *resolvedConn:
+			return c.ips
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// dialContext is the DialContext of the proxy Transport, see resolveDial. The
+// transport may hand the connection to another request than the one it was
+// dialed for, so the resolved addresses travel with the connection.
+func (proxy *ProxyHttpServer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, ips, err := proxy.resolveDial(ctx, network, addr)
+	if err != nil || ips == nil {
+		return conn, err
+	}
+	return &resolvedConn{conn, ips}, nil
+}
+
+// resolveDial dials addr, resolving its host with the proxy Resolver and
+// trying the addresses the IPPolicy allows in order. The whole dial is bounded
+// by the Dial timeout. The resolved addresses are returned along with the
+// connection, they are nil when the host was left to the dialer.
+func (proxy *ProxyHttpServer) resolveDial(ctx context.Context, network, addr string) (net.Conn, []net.IP, error) {
+	if proxy.Timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, proxy.Timeouts.Dial)
+		defer cancel()
+	}
+	var d net.Dialer
+	resolver := proxy.Resolver
+	if resolver == nil {
+		if proxy.IPPolicy == nil {
+			conn, err := d.DialContext(ctx, network, addr)
+			return conn, nil, err
+		}
+		resolver = net.DefaultResolver
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	if proxy.IPPolicy != nil {
+		if addrs, err = proxy.IPPolicy.filter(host, addrs); err != nil {
+			return nil, nil, err
+		}
+	}
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return conn, ips, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// dial dials addr for the request of ctx, see resolveDial, and records the
+// resolved addresses on ctx.
+func (ctx *ProxyCtx) dial(network, addr string) (net.Conn, error) {
+	conn, ips, err := ctx.proxy.resolveDial(context.Background(), network, addr)
+	if ips != nil {
+		ctx.ResolvedIPs = ips
+	}
+	return conn, err
+}
+
+// dialerFunc adapts a dial function to proxy.Dialer.
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
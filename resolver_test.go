@@ -0,0 +1,270 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answers A queries for every name with ip and a TTL of ttl seconds,
+// and AAAA queries with no records.
+type stubDNS struct {
+	ip      net.IP
+	ttl     uint32
+	queries int32
+}
+
+func (s *stubDNS) answer(query []byte) []byte {
+	atomic.AddInt32(&s.queries, 1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.Header.ID, Response: true},
+		Questions: msg.Questions,
+	}
+	if q.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], s.ip.To4())
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: s.ttl},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	b, _ := resp.Pack()
+	return b
+}
+
+func (s *stubDNS) serveUDP(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	orFatal("listen udp", err, t)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(s.answer(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// dnsTransportFunc adapts a function to DNSTransport.
+type dnsTransportFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f dnsTransportFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+func TestDNSResolverRejectsOtherQuestion(t *testing.T) {
+	stub := &stubDNS{ip: net.ParseIP("10.1.2.3"), ttl: 60}
+	r := NewDNSResolver(dnsTransportFunc(func(ctx context.Context, query []byte) ([]byte, error) {
+		var msg dnsmessage.Message
+		orFatal("unpack query", msg.Unpack(query), t)
+		msg.Questions[0].Name = dnsmessage.MustNewName("other.test.")
+		query, err := msg.Pack()
+		orFatal("pack query", err, t)
+		return stub.answer(query), nil
+	}))
+	if addrs, err := r.LookupIPAddr(context.Background(), "example.test"); err == nil {
+		t.Errorf("expected an error for an answer to another name, got %v", addrs)
+	}
+}
+
+func TestDNSResolverCachesByTTL(t *testing.T) {
+	stub := &stubDNS{ip: net.ParseIP("10.1.2.3"), ttl: 60}
+	addr, done := stub.serveUDP(t)
+	defer done()
+
+	r := NewDNSResolver(DNSOverUDP(addr))
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupIPAddr(context.Background(), "Example.test")
+		orFatal("lookup", err, t)
+		if len(addrs) != 1 || !addrs[0].IP.Equal(stub.ip) {
+			t.Fatalf("unexpected addresses %v", addrs)
+		}
+	}
+	// one A and one AAAA query, then answers come from the cache
+	if n := atomic.LoadInt32(&stub.queries); n != 2 {
+		t.Errorf("expected 2 upstream queries, got %d", n)
+	}
+	entry := r.cache["example.test."]
+	if ttl := time.Until(entry.expires); ttl <= 59*time.Second || ttl > 60*time.Second {
+		t.Errorf("expected the answer to be cached for its TTL, expires in %v", ttl)
+	}
+
+	r.MaxTTL = time.Nanosecond
+	r.Flush()
+	r.LookupIPAddr(context.Background(), "example.test")
+	time.Sleep(time.Millisecond)
+	r.LookupIPAddr(context.Background(), "example.test")
+	if n := atomic.LoadInt32(&stub.queries); n != 6 {
+		t.Errorf("expected expired answers to be queried again, got %d queries", n)
+	}
+}
+
+func TestDNSResolverCacheBounded(t *testing.T) {
+	stub := &stubDNS{ip: net.ParseIP("10.1.2.3"), ttl: 60}
+	addr, done := stub.serveUDP(t)
+	defer done()
+
+	r := NewDNSResolver(DNSOverUDP(addr))
+	r.MaxEntries = 2
+	for _, host := range []string{"a.test", "b.test", "c.test"} {
+		_, err := r.LookupIPAddr(context.Background(), host)
+		orFatal("lookup "+host, err, t)
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := r.cache["a.test."]; ok || len(r.cache) != 2 {
+		t.Errorf("expected the answer expiring first to be evicted, cached %d", len(r.cache))
+	}
+}
+
+func TestDNSResolverHosts(t *testing.T) {
+	r := NewDNSResolver(DNSOverUDP("127.0.0.1:1"))
+	err := r.LoadHosts(strings.NewReader("# comment\n10.0.0.7 blocked.test alias.test\n::1 blocked.test\n"))
+	orFatal("load hosts", err, t)
+	addrs, err := r.LookupIPAddr(context.Background(), "alias.test")
+	orFatal("lookup", err, t)
+	if len(addrs) != 1 || addrs[0].String() != "10.0.0.7" {
+		t.Errorf("unexpected addresses for alias.test %v", addrs)
+	}
+	addrs, err = r.LookupIPAddr(context.Background(), "BLOCKED.test")
+	orFatal("lookup", err, t)
+	if len(addrs) != 2 || addrs[1].String() != "::1" {
+		t.Errorf("unexpected addresses for blocked.test %v", addrs)
+	}
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	stub := &stubDNS{ip: net.ParseIP("10.4.5.6"), ttl: 60}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stub.answer(query))
+	}))
+	defer srv.Close()
+
+	r := NewDNSResolver(DNSOverHTTPS(srv.URL+"/dns-query", nil))
+	addrs, err := r.LookupIPAddr(context.Background(), "doh.test")
+	orFatal("lookup", err, t)
+	if len(addrs) != 1 || !addrs[0].IP.Equal(stub.ip) {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	stub := &stubDNS{ip: net.ParseIP("10.7.8.9"), ttl: 60}
+	// borrow the certificate of httptest, valid for 127.0.0.1
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certSrv.TLS.Certificates})
+	orFatal("listen", err, t)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := stub.answer(query)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certSrv.Certificate())
+	r := NewDNSResolver(DNSOverTLS(l.Addr().String(), &tls.Config{RootCAs: roots}))
+	addrs, err := r.LookupIPAddr(context.Background(), "dot.test")
+	orFatal("lookup", err, t)
+	if len(addrs) != 1 || !addrs[0].IP.Equal(stub.ip) {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+}
+
+func TestDialRecordsResolvedIPs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	stub := &stubDNS{ip: net.ParseIP("127.0.0.1"), ttl: 60}
+	addr, done := stub.serveUDP(t)
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	proxy.Resolver = NewDNSResolver(DNSOverUDP(addr))
+	ctx := &ProxyCtx{proxy: proxy}
+	conn, err := ctx.dial("tcp", net.JoinHostPort("upstream.test", port))
+	orFatal("dial", err, t)
+	conn.Close()
+	if len(ctx.ResolvedIPs) != 1 || !ctx.ResolvedIPs[0].Equal(stub.ip) {
+		t.Errorf("unexpected resolved IPs %v", ctx.ResolvedIPs)
+	}
+}
+
+func TestRoundTripRecordsResolvedIPs(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	stub := &stubDNS{ip: net.ParseIP("127.0.0.1"), ttl: 60}
+	addr, done := stub.serveUDP(t)
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	proxy.Resolver = NewDNSResolver(DNSOverUDP(addr))
+	resolved := make(chan []net.IP, 2)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		resolved <- ctx.ResolvedIPs
+		return resp
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// the second request reuses the connection dialed for the first
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://" + net.JoinHostPort("upstream.test", port) + "/")
+		orFatal("get", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if ips := <-resolved; len(ips) != 1 || !ips[0].Equal(stub.ip) {
+			t.Errorf("request %d: unexpected resolved IPs %v", i, ips)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package goproxy
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// DefaultSessionCacheSize is the number of TLS sessions a SessionCache keeps
+// when created with a capacity below 1.
+const DefaultSessionCacheSize = 1024
+
+// SessionCache is a bounded LRU cache of upstream TLS session tickets shared
+// by every uTLS dial the proxy makes. Entries are keyed by the SNI and the
+// ClientHelloID used for the handshake, so a session negotiated with one
+// fingerprint is never offered by another.
+//
+// A *SessionCache can be assigned directly to tls.Config.ClientSessionCache,
+// the dial helpers will then key it by the ClientHelloID they use.
+type SessionCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+
+	lookups    int64
+	hits       int64
+	handshakes int64
+	resumed    int64
+}
+
+type sessionCacheEntry struct {
+	key   string
+	state *tls.ClientSessionState
+}
+
+// SessionCacheStats is a snapshot of the SessionCache counters.
+type SessionCacheStats struct {
+	// Entries is the number of sessions currently cached
+	Entries int
+	// Lookups and Hits count cache lookups made by the TLS stack
+	Lookups int64
+	Hits    int64
+	// Handshakes counts completed upstream handshakes and Resumed those
+	// that the server accepted as a resumption
+	Handshakes int64
+	Resumed    int64
+}
+
+// HitRate returns the fraction of upstream handshakes that resumed a session.
+func (s SessionCacheStats) HitRate() float64 {
+	if s.Handshakes == 0 {
+		return 0
+	}
+	return float64(s.Resumed) / float64(s.Handshakes)
+}
+
+// NewSessionCache returns a SessionCache holding at most capacity sessions.
+// If capacity is less than 1, DefaultSessionCacheSize is used.
+func NewSessionCache(capacity int) *SessionCache {
+	if capacity < 1 {
+		capacity = DefaultSessionCacheSize
+	}
+	return &SessionCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get implements tls.ClientSessionCache for handshakes that are not keyed by
+// a ClientHelloID.
+func (c *SessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.get("|" + sessionKey)
+}
+
+// Put implements tls.ClientSessionCache.
+func (c *SessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.put("|"+sessionKey, cs)
+}
+
+// ForHello returns a view of the cache whose entries are keyed by id in
+// addition to the SNI.
+func (c *SessionCache) ForHello(id tls.ClientHelloID) tls.ClientSessionCache {
+	return &helloSessionCache{cache: c, prefix: helloKey(id) + "|"}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *SessionCache) Stats() SessionCacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return SessionCacheStats{
+		Entries:    entries,
+		Lookups:    atomic.LoadInt64(&c.lookups),
+		Hits:       atomic.LoadInt64(&c.hits),
+		Handshakes: atomic.LoadInt64(&c.handshakes),
+		Resumed:    atomic.LoadInt64(&c.resumed),
+	}
+}
+
+func (c *SessionCache) get(key string) (*tls.ClientSessionState, bool) {
+	atomic.AddInt64(&c.lookups, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*sessionCacheEntry).state, true
+}
+
+func (c *SessionCache) put(key string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		// a nil state means the server invalidated the session
+		if cs == nil {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			return
+		}
+		elem.Value.(*sessionCacheEntry).state = cs
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if cs == nil {
+		return
+	}
+	if c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionCacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&sessionCacheEntry{key: key, state: cs})
+}
+
+// recordHandshake updates the resumption counters after an upstream handshake.
+func (c *SessionCache) recordHandshake(state tls.ConnectionState) {
+	atomic.AddInt64(&c.handshakes, 1)
+	if state.DidResume {
+		atomic.AddInt64(&c.resumed, 1)
+	}
+}
+
+type helloSessionCache struct {
+	cache  *SessionCache
+	prefix string
+}
+
+func (h *helloSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return h.cache.get(h.prefix + sessionKey)
+}
+
+func (h *helloSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	h.cache.put(h.prefix+sessionKey, cs)
+}
+
+// sessionCacheFor returns the SessionCache backing cfg, if any.
+func sessionCacheFor(cfg *tls.Config) *SessionCache {
+	if cfg == nil {
+		return nil
+	}
+	switch cache := cfg.ClientSessionCache.(type) {
+	case *SessionCache:
+		return cache
+	case *helloSessionCache:
+		return cache.cache
+	}
+	return nil
+}
+
+// helloKey identifies a ClientHelloID in cache and pool keys. Randomized
+// IDs with custom Weights produce different hellos and get their own key.
+// The Seed is left out, uTLS fills it in for every randomized handshake.
+func helloKey(id tls.ClientHelloID) string {
+	key := id.Client + "-" + id.Version
+	if id.Weights != nil {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%v", *id.Weights)
+		key += fmt.Sprintf("-%08x", h.Sum32())
+	}
+	return key
+}
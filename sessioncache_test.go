@@ -0,0 +1,62 @@
+package goproxy
+
+import (
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func TestSessionCacheKeyedByHello(t *testing.T) {
+	cache := NewSessionCache(2)
+	chrome := cache.ForHello(tls.HelloChrome_Auto)
+	firefox := cache.ForHello(tls.HelloFirefox_Auto)
+
+	chrome.Put("example.com", &tls.ClientSessionState{})
+	if _, ok := chrome.Get("example.com"); !ok {
+		t.Fatal("expected session for chrome fingerprint")
+	}
+	if _, ok := firefox.Get("example.com"); ok {
+		t.Fatal("session leaked to another fingerprint")
+	}
+
+	stats := cache.Stats()
+	if stats.Lookups != 2 || stats.Hits != 1 || stats.Entries != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSessionCacheKeyedByWeights(t *testing.T) {
+	cache := NewSessionCache(2)
+	cache.ForHello(tls.HelloRandomizedNoALPN).Put("example.com", &tls.ClientSessionState{})
+	if _, ok := cache.ForHello(RandomizedMaxTlsHelloIdNoALPN).Get("example.com"); ok {
+		t.Fatal("session leaked to a hello with other weights")
+	}
+}
+
+func TestSessionCacheEvictsOldest(t *testing.T) {
+	cache := NewSessionCache(2)
+	cache.Put("a", &tls.ClientSessionState{})
+	cache.Put("b", &tls.ClientSessionState{})
+	cache.Get("a")
+	cache.Put("c", &tls.ClientSessionState{})
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("least recently used session was not evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Error("recently used session was evicted")
+	}
+	cache.Put("a", nil)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("nil Put did not invalidate the session")
+	}
+}
+
+func TestSessionCacheHitRate(t *testing.T) {
+	cache := NewSessionCache(0)
+	cache.recordHandshake(tls.ConnectionState{})
+	cache.recordHandshake(tls.ConnectionState{DidResume: true})
+	if rate := cache.Stats().HitRate(); rate != 0.5 {
+		t.Errorf("expected hit rate 0.5, got %v", rate)
+	}
+}
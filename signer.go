@@ -14,6 +14,7 @@ import (
 	"net"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
 
 	tls "github.com/refraction-networking/utls"
@@ -67,7 +68,12 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		BasicConstraintsValid: true,
 	}
 	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
+		// neither the brackets nor the zone of an IPv6 literal are part of the SAN
+		literal := strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+		if i := strings.IndexByte(literal, '%'); i >= 0 {
+			literal = literal[:i]
+		}
+		if ip := net.ParseIP(literal); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
 		} else {
 			template.DNSNames = append(template.DNSNames, h)
@@ -0,0 +1,120 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// Timeouts bounds the phases of the connections the proxy handles itself:
+// CONNECT tunnels, MITM'd sessions and websockets. Requests forwarded
+// through Tr are bounded by the http.Transport settings instead. A zero
+// duration disables the corresponding timeout.
+type Timeouts struct {
+	// Dial bounds TCP connects to upstream servers.
+	Dial time.Duration
+	// TLSHandshake bounds the MITM handshake with the client as well as
+	// each handshake with an upstream server.
+	TLSHandshake time.Duration
+	// ReadHeader bounds reading a request header on a hijacked connection
+	// once its first byte arrived, so that slow clients cannot hold the
+	// connection open by trickling bytes.
+	ReadHeader time.Duration
+	// KeepAliveIdle is how long a MITM'd connection may wait for its
+	// next request.
+	KeepAliveIdle time.Duration
+	// TunnelIdle closes CONNECT tunnels and websockets once no data moved
+	// in either direction for that long.
+	TunnelIdle time.Duration
+}
+
+// DefaultTimeouts are reasonable timeouts to set as ProxyHttpServer.Timeouts.
+// Tunnels get no idle timeout since protocols such as SSH may stay silent
+// for a long time.
+var DefaultTimeouts = Timeouts{
+	Dial:          30 * time.Second,
+	TLSHandshake:  15 * time.Second,
+	ReadHeader:    30 * time.Second,
+	KeepAliveIdle: 2 * time.Minute,
+}
+
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// dialTimeout dials addr directly through the proxy Resolver, bounded by the
+// Dial timeout.
+func (proxy *ProxyHttpServer) dialTimeout(network, addr string) (net.Conn, error) {
+	conn, _, err := proxy.resolveDial(context.Background(), network, addr)
+	return conn, err
+}
+
+// handshakeTimeout runs handshake with a deadline of d set on conn.
+func handshakeTimeout(conn net.Conn, d time.Duration, handshake func() error) error {
+	conn.SetDeadline(deadline(d))
+	if err := handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// awaitRequest waits up to KeepAliveIdle for the next request on conn and
+// then arms the ReadHeader timeout, the caller clears the read deadline once
+// the header was read. It returns false when the client went away or idled.
+func (proxy *ProxyHttpServer) awaitRequest(ctx *ProxyCtx, conn net.Conn, r *bufio.Reader) bool {
+	conn.SetReadDeadline(deadline(proxy.Timeouts.KeepAliveIdle))
+	if _, err := r.Peek(1); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			ctx.Logf("Closing idle connection")
+		}
+		return false
+	}
+	conn.SetReadDeadline(deadline(proxy.Timeouts.ReadHeader))
+	return true
+}
+
+// withIdleTimeout returns conn with every read and write pushing its deadline
+// d into the future, so a tunnel over it fails once both directions were
+// idle for d. Half-closable connections stay half-closable.
+func withIdleTimeout(conn net.Conn, d time.Duration) net.Conn {
+	if d <= 0 {
+		return conn
+	}
+	c := &idleTimeoutConn{Conn: conn, timeout: d}
+	if half, ok := conn.(halfClosable); ok {
+		return &idleTimeoutHalfConn{idleTimeoutConn: c, half: half}
+	}
+	return c
+}
+
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+type idleTimeoutHalfConn struct {
+	*idleTimeoutConn
+	half halfClosable
+}
+
+func (c *idleTimeoutHalfConn) CloseWrite() error {
+	return c.half.CloseWrite()
+}
+
+func (c *idleTimeoutHalfConn) CloseRead() error {
+	return c.half.CloseRead()
+}
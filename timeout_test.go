@@ -0,0 +1,69 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := withIdleTimeout(a, 50*time.Millisecond)
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			b.Write([]byte{'x'})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatalf("read %d on active connection failed: %v", i, err)
+		}
+	}
+	_, err := conn.Read(buf)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected timeout on idle connection, got %v", err)
+	}
+}
+
+func TestSlowRequestHeaderIsDropped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.Timeouts.ReadHeader = 100 * time.Millisecond
+	proxy.OnRequest().HandleConnect(FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		return HTTPMitmConnect, host
+	}))
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	host := upstream.Listener.Addr().String()
+	_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	orFatal("write CONNECT", err, t)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	orFatal("read CONNECT response", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %s", resp.Status)
+	}
+
+	// start a request and never finish its header
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\n")
+	orFatal("write partial request", err, t)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected the proxy to close the connection, got %v", err)
+	}
+}
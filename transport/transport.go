@@ -14,6 +14,8 @@ package transport
 import (
 	"bufio"
 	"compress/gzip"
+	"container/list"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -27,6 +29,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // DefaultTransport is the default implementation of Transport and is
@@ -46,10 +49,9 @@ const DefaultMaxIdleConnsPerHost = 2
 type Transport struct {
 	lk       sync.Mutex
 	idleConn map[string][]*persistConn
+	idleLRU  *list.List              // of *persistConn, least recently idled at the front
 	altProto map[string]RoundTripper // nil or map of URI scheme => RoundTripper
 
-	// TODO: tunable on global max cached connections
-	// TODO: tunable on timeout on cached connections
 	// TODO: optional pipelining
 
 	// Proxy specifies a function to return a proxy for a given
@@ -61,8 +63,22 @@ type Transport struct {
 	// Dial specifies the dial function for creating TCP
 	// connections.
 	// If Dial is nil, net.Dial is used.
+	//
+	// Deprecated: Use DialContext instead, which allows the transport
+	// to cancel dials as soon as they are no longer needed.
 	Dial func(net, addr string) (c net.Conn, err error)
 
+	// DialContext specifies the dial function for creating TCP
+	// connections. It takes precedence over Dial.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialTimeout, if non-zero, bounds the dial of a new connection.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout, if non-zero, bounds the TLS handshake with
+	// the server.
+	TLSHandshakeTimeout time.Duration
+
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
@@ -74,6 +90,15 @@ type Transport struct {
 	// (keep-alive) to keep to keep per-host.  If zero,
 	// DefaultMaxIdleConnsPerHost is used.
 	MaxIdleConnsPerHost int
+
+	// MaxIdleConns, if non-zero, caps the idle (keep-alive)
+	// connections across all hosts. The connection idle the longest
+	// is closed to make room for a new one.
+	MaxIdleConns int
+
+	// IdleConnTimeout, if non-zero, is how long an idle (keep-alive)
+	// connection stays in the pool before it is closed.
+	IdleConnTimeout time.Duration
 }
 
 // ProxyFromEnvironment returns the URL of the proxy to use for a
@@ -161,7 +186,7 @@ func (t *Transport) DetailedRoundTrip(req *http.Request) (details *RoundTripDeta
 	// host (for http or https), the http proxy, or the http proxy
 	// pre-CONNECTed to https server.  In any case, we'll be ready
 	// to send it requests.
-	pconn, err := t.getConn(cm)
+	pconn, err := t.getConn(req.Context(), cm)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -209,10 +234,12 @@ func (t *Transport) CloseIdleConnections() {
 	}
 	for _, conns := range t.idleConn {
 		for _, pconn := range conns {
+			pconn.stopIdleTimer()
 			pconn.close()
 		}
 	}
 	t.idleConn = make(map[string][]*persistConn)
+	t.idleLRU = nil
 }
 
 //
@@ -276,7 +303,23 @@ func (t *Transport) putIdleConn(pconn *persistConn) bool {
 		pconn.close()
 		return false
 	}
+	if t.MaxIdleConns > 0 && t.idleLRU != nil && t.idleLRU.Len() >= t.MaxIdleConns {
+		// make room by evicting the connection idle the longest
+		oldest := t.idleLRU.Front().Value.(*persistConn)
+		t.removeIdleConnLocked(oldest)
+		oldest.close()
+	}
+	if t.idleConn == nil {
+		t.idleConn = make(map[string][]*persistConn)
+	}
+	if t.idleLRU == nil {
+		t.idleLRU = list.New()
+	}
 	t.idleConn[key] = append(t.idleConn[key], pconn)
+	pconn.idleElem = t.idleLRU.PushBack(pconn)
+	if t.IdleConnTimeout > 0 {
+		pconn.idleTimer = time.AfterFunc(t.IdleConnTimeout, pconn.closeIfStillIdle)
+	}
 	return true
 }
 
@@ -292,57 +335,107 @@ func (t *Transport) getIdleConn(cm *connectMethod) (pconn *persistConn) {
 		if !ok {
 			return nil
 		}
-		if len(pconns) == 1 {
-			pconn = pconns[0]
-			delete(t.idleConn, key)
-		} else {
-			// 2 or more cached connections; pop last
-			// TODO: queue?
-			pconn = pconns[len(pconns)-1]
-			t.idleConn[key] = pconns[0 : len(pconns)-1]
-		}
-		if !pconn.isBroken() {
+		// pop the most recently used connection
+		pconn = pconns[len(pconns)-1]
+		t.removeIdleConnLocked(pconn)
+		// a connection whose idle timer already fired is being closed
+		if pconn.stopIdleTimer() && !pconn.isBroken() {
 			return
 		}
 	}
 }
 
-func (t *Transport) dial(network, addr string) (c net.Conn, raddr string, ip *net.TCPAddr, err error) {
-	if t.Dial != nil {
-		ip, err = net.ResolveTCPAddr("tcp", addr)
-		if err != nil {
+// removeIdleConn takes pconn out of the idle pool, if it is there.
+func (t *Transport) removeIdleConn(pconn *persistConn) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.removeIdleConnLocked(pconn)
+}
+
+func (t *Transport) removeIdleConnLocked(pconn *persistConn) {
+	if pconn.idleElem == nil {
+		return
+	}
+	t.idleLRU.Remove(pconn.idleElem)
+	pconn.idleElem = nil
+	pconns := t.idleConn[pconn.cacheKey]
+	for i, pc := range pconns {
+		if pc == pconn {
+			pconns = append(pconns[:i:i], pconns[i+1:]...)
+			break
+		}
+	}
+	if len(pconns) == 0 {
+		delete(t.idleConn, pconn.cacheKey)
+	} else {
+		t.idleConn[pconn.cacheKey] = pconns
+	}
+}
+
+func (t *Transport) dial(ctx context.Context, network, addr string) (c net.Conn, raddr string, ip *net.TCPAddr, err error) {
+	if t.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.DialTimeout)
+		defer cancel()
+	}
+	raddr = addr
+	if t.DialContext != nil || t.Dial != nil {
+		// a custom dialer may not connect to addr itself, e.g. when it
+		// goes through a SOCKS proxy, so resolve the target on our own
+		if ip, err = net.ResolveTCPAddr("tcp", addr); err != nil {
 			return
 		}
-		c, err = t.Dial(network, addr)
-		raddr = addr
+		if t.DialContext != nil {
+			c, err = t.DialContext(ctx, network, addr)
+		} else {
+			c, err = t.Dial(network, addr)
+		}
 		return
 	}
-	addri, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
+	var d net.Dialer
+	if c, err = d.DialContext(ctx, "tcp", addr); err != nil {
 		return
 	}
-	c, err = net.DialTCP("tcp", nil, addri)
-	raddr = addr
-	ip = addri
+	ip, _ = c.RemoteAddr().(*net.TCPAddr)
 	return
 }
 
+// closeOnCancel closes conn once ctx is done, until the returned function
+// is called. It unblocks the reads and writes of a connection setup the
+// request was canceled during.
+func closeOnCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
 // getConn dials and creates a new persistConn to the target as
 // specified in the connectMethod.  This includes doing a proxy CONNECT
 // and/or setting up TLS.  If this doesn't return an error, the persistConn
 // is ready to write requests to.
-func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
+func (t *Transport) getConn(ctx context.Context, cm *connectMethod) (*persistConn, error) {
 	if pc := t.getIdleConn(cm); pc != nil {
 		return pc, nil
 	}
 
-	conn, raddr, ip, err := t.dial("tcp", cm.addr())
+	conn, raddr, ip, err := t.dial(ctx, "tcp", cm.addr())
 	if err != nil {
 		if cm.proxyURL != nil {
 			err = fmt.Errorf("http: error connecting to proxy %s: %v", cm.proxyURL, err)
 		}
 		return nil, err
 	}
+	stop := closeOnCancel(ctx, conn)
+	defer stop()
 
 	pa := cm.proxyAuth()
 
@@ -384,6 +477,9 @@ func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
 		resp, err := http.ReadResponse(br, connectReq)
 		if err != nil {
 			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
 			return nil, err
 		}
 		if resp.StatusCode != 200 {
@@ -395,12 +491,28 @@ func (t *Transport) getConn(cm *connectMethod) (*persistConn, error) {
 
 	if cm.targetScheme == "https" {
 		// Initiate TLS and check remote host name against certificate.
-		conn = tls.Client(conn, t.TLSClientConfig)
+		cfg := &tls.Config{}
+		if t.TLSClientConfig != nil {
+			cfg = t.TLSClientConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = cm.tlsHost()
+		}
+		conn = tls.Client(conn, cfg)
+		if t.TLSHandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(t.TLSHandshakeTimeout))
+		}
 		if err = conn.(*tls.Conn).Handshake(); err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
 			return nil, err
 		}
+		conn.SetDeadline(time.Time{})
 		if t.TLSClientConfig == nil || !t.TLSClientConfig.InsecureSkipVerify {
 			if err = conn.(*tls.Conn).VerifyHostname(cm.tlsHost()); err != nil {
+				conn.Close()
 				return nil, err
 			}
 		}
@@ -501,7 +613,7 @@ func (cm *connectMethod) tlsHost() string {
 	if hasPort(h) {
 		h = h[:strings.LastIndex(h, ":")]
 	}
-	return h
+	return strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
 }
 
 // persistConn wraps a connection, usually a persistent one
@@ -526,6 +638,10 @@ type persistConn struct {
 
 	host string
 	ip   *net.TCPAddr
+
+	// guarded by t.lk
+	idleElem  *list.Element // in t.idleLRU while idle, else nil
+	idleTimer *time.Timer   // closes the connection after IdleConnTimeout
 }
 
 func (pc *persistConn) isBroken() bool {
@@ -534,6 +650,30 @@ func (pc *persistConn) isBroken() bool {
 	return pc.broken
 }
 
+// stopIdleTimer stops the idle timer of pc and reports whether it was
+// stopped before it fired. pc.t.lk must be held.
+func (pc *persistConn) stopIdleTimer() bool {
+	if pc.idleTimer == nil {
+		return true
+	}
+	stopped := pc.idleTimer.Stop()
+	pc.idleTimer = nil
+	return stopped
+}
+
+// closeIfStillIdle evicts pc from the idle pool once IdleConnTimeout
+// elapsed, unless a request took it out in the meantime.
+func (pc *persistConn) closeIfStillIdle() {
+	t := pc.t
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if pc.idleElem == nil {
+		return
+	}
+	t.removeIdleConnLocked(pc)
+	pc.close()
+}
+
 var remoteSideClosedFunc func(error) bool // or nil to use default
 
 func remoteSideClosed(err error) bool {
@@ -557,6 +697,7 @@ func (pc *persistConn) readLoop() {
 		if pc.numExpectedResponses == 0 {
 			pc.closeLocked()
 			pc.lk.Unlock()
+			pc.t.removeIdleConn(pc)
 			if len(pb) > 0 {
 				log.Printf("Unsolicited response received on idle HTTP channel starting with %q; err=%v",
 					string(pb), err)
@@ -603,12 +744,12 @@ func (pc *persistConn) readLoop() {
 		if alive {
 			if hasBody {
 				lastbody = resp.Body
-				waitForBodyRead = make(chan bool)
-				resp.Body.(*bodyEOFSignal).fn = func() {
-					if !pc.t.putIdleConn(pc) {
-						alive = false
+				waitForBodyRead = make(chan bool, 1)
+				resp.Body.(*bodyEOFSignal).fn = func(err error) {
+					if err != nil {
+						pc.close()
 					}
-					waitForBodyRead <- true
+					waitForBodyRead <- err == nil && pc.t.putIdleConn(pc)
 				}
 			} else {
 				// When there's no response body, we immediately
@@ -629,9 +770,16 @@ func (pc *persistConn) readLoop() {
 		rc.ch <- responseAndError{resp, err}
 
 		// Wait for the just-returned response body to be fully consumed
-		// before we race and peek on the underlying bufio reader.
+		// before we race and peek on the underlying bufio reader. A
+		// request canceled meanwhile tears the connection down.
 		if waitForBodyRead != nil {
-			<-waitForBodyRead
+			select {
+			case alive = <-waitForBodyRead:
+			case <-rc.req.Context().Done():
+				pc.close()
+				pc.t.removeIdleConn(pc)
+				alive = false
+			}
 		}
 	}
 }
@@ -674,20 +822,40 @@ func (pc *persistConn) roundTrip(req *transportRequest) (resp *http.Response, er
 	pc.lk.Unlock()
 
 	// orig: err = req.Request.write(pc.bw, pc.isProxy, req.extra)
+	stop := closeOnCancel(req.Context(), pc.conn)
 	if pc.isProxy {
 		err = req.Request.WriteProxy(pc.bw)
 	} else {
 		err = req.Request.Write(pc.bw)
 	}
+	if err == nil {
+		err = pc.bw.Flush()
+	}
+	stop()
 	if err != nil {
 		pc.close()
+		if req.Context().Err() != nil {
+			err = req.Context().Err()
+		}
 		return
 	}
-	pc.bw.Flush()
 
 	ch := make(chan responseAndError, 1)
 	pc.reqch <- requestAndChan{req.Request, ch, requestedGzip}
-	re := <-ch
+	var re responseAndError
+	select {
+	case re = <-ch:
+	case <-req.Context().Done():
+		// tear the connection down, the pending read fails and
+		// readLoop moves on
+		pc.close()
+		re.err = req.Context().Err()
+		go func() {
+			if late := <-ch; late.res != nil {
+				late.res.Body.Close()
+			}
+		}()
+	}
 	pc.lk.Lock()
 	pc.numExpectedResponses--
 	pc.lk.Unlock()
@@ -728,10 +896,11 @@ func responseIsKeepAlive(res *http.Response) bool {
 
 // bodyEOFSignal wraps a ReadCloser but runs fn (if non-nil) at most
 // once, right before the final Read() or Close() call returns, but after
-// EOF has been seen.
+// EOF has been seen. fn is passed the error, if any, that ended the body
+// early.
 type bodyEOFSignal struct {
 	body     io.ReadCloser
-	fn       func()
+	fn       func(error)
 	isClosed bool
 }
 
@@ -740,8 +909,12 @@ func (es *bodyEOFSignal) Read(p []byte) (n int, err error) {
 	if es.isClosed && n > 0 {
 		panic("http: unexpected bodyEOFSignal Read after Close; see issue 1725")
 	}
-	if err == io.EOF && es.fn != nil {
-		es.fn()
+	if err != nil && es.fn != nil {
+		if err == io.EOF {
+			es.fn(nil)
+		} else {
+			es.fn(err)
+		}
 		es.fn = nil
 	}
 	return
@@ -753,8 +926,8 @@ func (es *bodyEOFSignal) Close() (err error) {
 	}
 	es.isClosed = true
 	err = es.body.Close()
-	if err == nil && es.fn != nil {
-		es.fn()
+	if es.fn != nil {
+		es.fn(err)
 		es.fn = nil
 	}
 	return
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, tr *Transport, url string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal("round trip", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func (t *Transport) idleCount() int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if t.idleLRU == nil {
+		return 0
+	}
+	return t.idleLRU.Len()
+}
+
+// countingServer counts the connections it accepted.
+func countingServer(h http.Handler) (*httptest.Server, *int32) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	return srv, &conns
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	srv, conns := countingServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	tr := &Transport{IdleConnTimeout: 50 * time.Millisecond}
+	get(t, tr, srv.URL)
+	get(t, tr, srv.URL)
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Fatalf("expected the idle connection to be reused, got %d connections", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := tr.idleCount(); n != 0 {
+		t.Fatalf("expected the idle connection to be evicted, %d still idle", n)
+	}
+	get(t, tr, srv.URL)
+	if n := atomic.LoadInt32(conns); n != 2 {
+		t.Errorf("expected a new connection after the idle timeout, got %d connections", n)
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	srv1, conns1 := countingServer(h)
+	defer srv1.Close()
+	srv2, _ := countingServer(h)
+	defer srv2.Close()
+
+	tr := &Transport{MaxIdleConns: 1}
+	get(t, tr, srv1.URL)
+	get(t, tr, srv2.URL)
+	if n := tr.idleCount(); n != 1 {
+		t.Fatalf("expected 1 idle connection, got %d", n)
+	}
+	// the connection to srv1 was evicted to make room for srv2
+	get(t, tr, srv1.URL)
+	if n := atomic.LoadInt32(conns1); n != 2 {
+		t.Errorf("expected the oldest idle connection to be evicted, got %d connections", n)
+	}
+}
+
+func TestRequestCancelTearsDownConn(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv, conns := countingServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	tr := &Transport{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	details, _, err := tr.DetailedRoundTrip(req.WithContext(ctx))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to be canceled, got %v", err)
+	}
+	if details == nil || details.TCPAddr == nil {
+		t.Errorf("expected round trip details, got %+v", details)
+	}
+	if n := tr.idleCount(); n != 0 {
+		t.Errorf("expected the canceled connection not to be pooled, %d idle", n)
+	}
+	if n := atomic.LoadInt32(conns); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	tr := &Transport{
+		DialTimeout: 20 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:1/", nil)
+	start := time.Now()
+	if _, err := tr.RoundTrip(req); err != context.DeadlineExceeded {
+		t.Errorf("expected the dial to time out, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("dial took %v", d)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	defer l.Close()
+	go func() {
+		// accept and never answer the client hello
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	tr := &Transport{TLSHandshakeTimeout: 50 * time.Millisecond}
+	req, _ := http.NewRequest("GET", "https://"+l.Addr().String()+"/", nil)
+	_, err = tr.RoundTrip(req)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected a handshake timeout, got %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package goproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// UpgradeStream is a connection the proxy streams once it switched from
+// HTTP to another protocol: after a 101 Switching Protocols, after a 2xx
+// answering a CONNECT sent inside an intercepted tunnel, or right after a
+// request with one of the TunnelMethods.
+type UpgradeStream struct {
+	clientBytes int64
+	serverBytes int64
+
+	// Protocol is the Upgrade header of the response, or the method of the
+	// request for CONNECTs and TunnelMethods.
+	Protocol string
+	// Resp is the response that switched protocols, after the response
+	// handlers. It is nil for TunnelMethods.
+	Resp *http.Response
+	// FromClient and FromServer read what each side sends, the upgrade
+	// handlers may replace them to observe or rewrite the streams.
+	FromClient io.Reader
+	FromServer io.Reader
+
+	done chan struct{}
+}
+
+// ClientBytes returns the number of bytes relayed from the client to the
+// server so far, as the upgrade handlers passed them.
+func (s *UpgradeStream) ClientBytes() int64 {
+	return atomic.LoadInt64(&s.clientBytes)
+}
+
+// ServerBytes returns the number of bytes relayed from the server to the
+// client so far, as the upgrade handlers passed them.
+func (s *UpgradeStream) ServerBytes() int64 {
+	return atomic.LoadInt64(&s.serverBytes)
+}
+
+// Done is closed once both directions of the stream ended.
+func (s *UpgradeStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// countingWriter adds the bytes written to w to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// isUpgradeRequest reports whether req asks to switch the connection it is
+// sent on to another protocol.
+func (proxy *ProxyHttpServer) isUpgradeRequest(req *http.Request) bool {
+	return req.Method == "CONNECT" || proxy.isTunnelMethod(req.Method) ||
+		(headerContains(req.Header, "Connection", "upgrade") && req.Header.Get("Upgrade") != "")
+}
+
+func (proxy *ProxyHttpServer) isTunnelMethod(method string) bool {
+	for _, m := range proxy.TunnelMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// writeUpgradeRequest sends req upstream on w. The body of a request with
+// one of the TunnelMethods is part of the stream, only its head is written.
+func (proxy *ProxyHttpServer) writeUpgradeRequest(w io.Writer, req *http.Request) error {
+	if !proxy.isTunnelMethod(req.Method) {
+		return req.Write(w)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	head := req.Method + " " + req.URL.RequestURI() + " HTTP/1.1\r\nHost: " + host + "\r\n"
+	if len(req.TransferEncoding) > 0 {
+		head += "Transfer-Encoding: " + strings.Join(req.TransferEncoding, ", ") + "\r\n"
+	} else if req.ContentLength > 0 {
+		head += "Content-Length: " + strconv.FormatInt(req.ContentLength, 10) + "\r\n"
+	}
+	if _, err := io.WriteString(w, head); err != nil {
+		return err
+	}
+	if err := req.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// switchedProtocols reports whether resp accepted the switch req asked for.
+func switchedProtocols(req *http.Request, resp *http.Response) bool {
+	if req.Method == "CONNECT" {
+		return resp.StatusCode/100 == 2
+	}
+	return resp.StatusCode == http.StatusSwitchingProtocols
+}
+
+func (proxy *ProxyHttpServer) serveUpgrade(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request) {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return
+	}
+
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		log.Printf("Upgrade error Hijack %s", err)
+		return
+	}
+	defer conn.Close()
+
+	remote, err := proxy.dialUpgrade(ctx, req, nil)
+	if err != nil {
+		log.Printf("Upgrade error connect %s", err)
+		httpError(conn, ctx, err)
+		return
+	}
+	defer remote.Close()
+	// the client may have sent its first bytes along with the request
+	client := withIdleTimeout(&bufferedConn{Conn: conn, r: brw.Reader}, proxy.Timeouts.TunnelIdle)
+	remote = withIdleTimeout(remote, proxy.Timeouts.TunnelIdle)
+
+	log.Printf("Got upgrade request %s %s", req.Host, req.URL)
+
+	if err := proxy.writeUpgradeRequest(remote, req); err != nil {
+		log.Printf("Upgrade error request %s", err)
+		return
+	}
+	proxy.relayUpgrade(ctx, req, client, remote)
+}
+
+// dialUpgrade connects to the server of req, which switches protocols, the
+// way other requests reach it: through the upstream proxy Tr.Proxy picks
+// for req, through ConnectDial, or directly with the proxy Resolver and
+// IPPolicy. https connections then handshake with the Fingerprints of MITM
+// upstream connections, offering only http/1.1. tlsConfig, or
+// WebsocketTLSConfig if nil, sets how the server is verified.
+func (proxy *ProxyHttpServer) dialUpgrade(ctx *ProxyCtx, req *http.Request, tlsConfig *tls.Config) (net.Conn, error) {
+	secure := req.URL.Scheme == "https" || req.URL.Scheme == "wss"
+	port := "80"
+	if secure {
+		port = "443"
+	}
+	addr := withDefaultPort(req.URL.Host, port)
+
+	dial := ctx.dial
+	if proxy.Tr != nil && proxy.Tr.Proxy != nil {
+		proxyURL, err := proxy.Tr.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			// newUpstreamDialer fills in the default port
+			u := *proxyURL
+			if dial, err = proxy.newUpstreamDialer(&u, nil); err != nil {
+				return nil, err
+			}
+		} else if proxy.ConnectDial != nil {
+			dial = proxy.ConnectDial
+		}
+	} else if proxy.ConnectDial != nil {
+		dial = proxy.ConnectDial
+	}
+	if !secure {
+		return dial("tcp", addr)
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = proxy.WebsocketTLSConfig
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = stripPort(addr)
+	}
+	// the response and what follows it are HTTP/1.1
+	candidates := []tls.ClientHelloID{tls.HelloRandomizedNoALPN}
+	if selector := proxy.Fingerprints; selector != nil {
+		candidates = selector.Candidates(addr, "http/1.1", candidates[0])
+	}
+	var lastErr error
+	for _, id := range candidates {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		tcpConn, err := dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := handshakeUpstream(ctx, tcpConn, tlsConfig, id)
+		if err != nil {
+			ctx.Logf("Cannot handshake upgrade: %s with %s %v", addr, helloKey(id), err)
+			lastErr = err
+			continue
+		}
+		if selector := proxy.Fingerprints; selector != nil {
+			selector.Learn(addr, "http/1.1", id)
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// relayUpgrade relays the response to req, which was written to remote,
+// through the response handlers to client. Once the protocol switched,
+// websockets go through the websocket handlers, when there are any, and
+// other streams through the upgrade handlers. Requests with one of the
+// TunnelMethods are streamed right away, their response is part of the
+// stream. The caller closes both connections.
+func (proxy *ProxyHttpServer) relayUpgrade(ctx *ProxyCtx, req *http.Request, client, remote io.ReadWriteCloser) {
+	defer ctx.upgradeEnded()
+	if proxy.isTunnelMethod(req.Method) {
+		proxy.streamUpgrade(ctx, &UpgradeStream{Protocol: req.Method, FromClient: client, FromServer: remote}, client, remote)
+		return
+	}
+
+	remoteReader := bufio.NewReader(remote)
+	resp, err := http.ReadResponse(remoteReader, req)
+	if err != nil {
+		ctx.Warnf("Error reading upgrade response: %v", err)
+		return
+	}
+	if req.Method == "CONNECT" && switchedProtocols(req, resp) {
+		// the tunnel follows the header, there is no body
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+	}
+	// the protocol is the one the server agreed to, whatever handlers
+	// tell the client
+	negotiated := resp.Header.Clone()
+	if resp = proxy.filterResponse(resp, ctx); resp == nil {
+		httpError(client, ctx, errors.New("upgrade response dropped"))
+		return
+	}
+	defer resp.Body.Close()
+	if err := resp.Write(client); err != nil {
+		ctx.Warnf("Error writing upgrade response: %v", err)
+		return
+	}
+	if !switchedProtocols(req, resp) {
+		return
+	}
+
+	protocol := negotiated.Get("Upgrade")
+	if req.Method == "CONNECT" {
+		protocol = req.Method
+	}
+	if len(proxy.websocketHandlers) > 0 && isWebSocketRequest(req) && headerContains(negotiated, "Upgrade", "websocket") {
+		clientDeflate, serverDeflate, ok := parseWSDeflate(negotiated)
+		if ok {
+			proxy.relayWebsocket(ctx, client, remote, remoteReader, clientDeflate, serverDeflate)
+			return
+		}
+		ctx.Warnf("Websocket extensions %q not supported, relaying frames unseen", negotiated.Get("Sec-Websocket-Extensions"))
+	}
+	proxy.streamUpgrade(ctx, &UpgradeStream{Protocol: protocol, Resp: resp, FromClient: client, FromServer: remoteReader}, client, remote)
+}
+
+// streamUpgrade relays s, once the upgrade handlers saw it, between client
+// and remote until either side ends.
+func (proxy *ProxyHttpServer) streamUpgrade(ctx *ProxyCtx, s *UpgradeStream, client, remote io.ReadWriteCloser) {
+	s.done = make(chan struct{})
+	defer close(s.done)
+	proxy.filterUpgrade(s, ctx)
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(countingWriter{remote, &s.clientBytes}, ctx.shapeReader(s.FromClient))
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(countingWriter{client, &s.serverBytes}, ctx.shapeReader(s.FromServer))
+		errc <- err
+	}()
+	if err := <-errc; err != nil {
+		ctx.Warnf("Error relaying %s stream: %v", s.Protocol, err)
+	}
+	// unblock the other direction
+	client.Close()
+	remote.Close()
+	<-errc
+	ctx.Logf("%s stream ended, %d bytes from client, %d bytes from server", s.Protocol, s.ClientBytes(), s.ServerBytes())
+}
@@ -0,0 +1,125 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// switchingServer answers a request with response, when it is not empty,
+// and then every line sent on the connection with "echo: " and the line.
+func switchingServer(t *testing.T, response string) (string, func()) {
+	return fakeUpstream(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		if _, err := http.ReadRequest(r); err != nil {
+			return
+		}
+		io.WriteString(c, response)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "echo: "+line)
+		}
+	})
+}
+
+func expectLineEcho(t *testing.T, conn net.Conn, r *bufio.Reader, line, expected string) {
+	_, err := io.WriteString(conn, line)
+	orFatal("write through stream", err, t)
+	got, err := r.ReadString('\n')
+	orFatal("read through stream", err, t)
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// upperReader upper-cases what r reads.
+type upperReader struct{ r io.Reader }
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return n, err
+}
+
+func TestUpgradeStreamed(t *testing.T) {
+	addr, done := switchingServer(t, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	streams := make(chan *UpgradeStream, 1)
+	proxy.OnUpgrade().DoFunc(func(s *UpgradeStream, ctx *ProxyCtx) {
+		s.FromClient = upperReader{s.FromClient}
+		streams <- s
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	_, err = io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	orFatal("write request", err, t)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("read response", err, t)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected response %s", resp.Status)
+	}
+	expectLineEcho(t, conn, r, "hello\n", "echo: HELLO\n")
+	conn.Close()
+
+	s := <-streams
+	<-s.Done()
+	if s.Protocol != "echo" || s.ClientBytes() != 6 || s.ServerBytes() != 12 {
+		t.Errorf("unexpected stream %q with %d bytes from client, %d from server", s.Protocol, s.ClientBytes(), s.ServerBytes())
+	}
+}
+
+func TestHTTPMitmUpgradeRefused(t *testing.T) {
+	addr, done := switchingServer(t, "HTTP/1.1 400 Bad Request\r\nContent-Length: 2\r\n\r\nno")
+	defer done()
+
+	conn, r, closeTunnel := httpMitmTunnel(t, addr)
+	defer closeTunnel()
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	orFatal("write request", err, t)
+	resp, body := readBody(t, r)
+	if resp.StatusCode != http.StatusBadRequest || body != "no" {
+		t.Errorf("expected the refusal, got %s %q", resp.Status, body)
+	}
+}
+
+func TestHTTPMitmConnectInsideTunnel(t *testing.T) {
+	addr, done := switchingServer(t, "HTTP/1.1 200 Connection established\r\n\r\n")
+	defer done()
+
+	conn, r, closeTunnel := httpMitmTunnel(t, addr)
+	defer closeTunnel()
+	_, err := io.WriteString(conn, "CONNECT inner.test:443 HTTP/1.1\r\nHost: inner.test:443\r\n\r\n")
+	orFatal("write CONNECT", err, t)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	orFatal("read CONNECT response", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %s", resp.Status)
+	}
+	expectLineEcho(t, conn, r, "hello\n", "echo: hello\n")
+}
+
+func TestHTTPMitmTunnelMethod(t *testing.T) {
+	addr, done := switchingServer(t, "")
+	defer done()
+
+	conn, r, closeTunnel := httpMitmTunnel(t, addr, func(proxy *ProxyHttpServer) {
+		proxy.TunnelMethods = append(proxy.TunnelMethods, "STREAM")
+	})
+	defer closeTunnel()
+	_, err := io.WriteString(conn, "STREAM / HTTP/1.1\r\nHost: "+addr+"\r\nContent-Length: 1000000\r\n\r\n")
+	orFatal("write request", err, t)
+	expectLineEcho(t, conn, r, "hello\n", "echo: hello\n")
+}
@@ -0,0 +1,448 @@
+package goproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamDialError is returned by the dialers of NewConnectDialToProxy when
+// the upstream proxy itself could not be reached.
+type UpstreamDialError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *UpstreamDialError) Error() string {
+	return fmt.Sprintf("cannot dial upstream proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *UpstreamDialError) Unwrap() error {
+	return e.Err
+}
+
+// TunnelRefusedError is returned by the dialers of NewConnectDialToProxy when
+// the upstream proxy was reached but refused to open a tunnel to Addr.
+// StatusCode is the status of the CONNECT response for HTTP proxies and
+// zero for SOCKS proxies.
+type TunnelRefusedError struct {
+	Proxy      string
+	Addr       string
+	StatusCode int
+	Reason     string
+}
+
+func (e *TunnelRefusedError) Error() string {
+	return fmt.Sprintf("upstream proxy %s refused connection to %s: %s", e.Proxy, e.Addr, e.Reason)
+}
+
+// UpstreamCredentials returns the credentials to answer the authentication
+// challenge of the upstream proxy at proxyURL with, ok is false when there
+// are none.
+type UpstreamCredentials func(proxyURL *url.URL) (username, password string, ok bool)
+
+// upstreamDialer dials through the upstream proxy at u.
+type upstreamDialer struct {
+	proxy *ProxyHttpServer
+	u     *url.URL
+	// dialProxy connects to the upstream proxy
+	dialProxy         func(network string) (net.Conn, error)
+	connectReqHandler func(req *http.Request)
+}
+
+// credentials returns the credentials for the upstream proxy, those of its
+// URL first.
+func (d *upstreamDialer) credentials() (string, string, bool) {
+	if d.u.User != nil {
+		password, _ := d.u.User.Password()
+		return d.u.User.Username(), password, true
+	}
+	if d.proxy.UpstreamCredentials != nil {
+		return d.proxy.UpstreamCredentials(d.u)
+	}
+	return "", "", false
+}
+
+// dialHTTP opens a tunnel to addr with CONNECT, answering a 407 challenge
+// with Basic or Digest authentication. Credentials of the URL are sent
+// right away with Basic authentication, as http.Transport does.
+func (d *upstreamDialer) dialHTTP(network, addr string) (net.Conn, error) {
+	var authorization string
+	if d.u.User != nil {
+		user, password, _ := d.credentials()
+		authorization = basicAuth(user, password)
+	}
+	c, resp, err := d.connect(network, addr, authorization)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		user, password, ok := d.credentials()
+		if challenged := challengeResponse(resp.Header, addr, user, password); ok && challenged != "" && challenged != authorization {
+			// not every proxy keeps the connection after a 407, start over
+			c.Close()
+			if c, resp, err = d.connect(network, addr, challenged); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+		c.Close()
+		reason := resp.Status
+		if len(body) > 0 {
+			reason += ": " + strings.TrimSpace(string(body))
+		}
+		return nil, &TunnelRefusedError{Proxy: d.u.Host, Addr: addr, StatusCode: resp.StatusCode, Reason: reason}
+	}
+	return c, nil
+}
+
+// connect sends a CONNECT request for addr over a new connection to the
+// upstream proxy and reads its response header.
+func (d *upstreamDialer) connect(network, addr, authorization string) (net.Conn, *http.Response, error) {
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if authorization != "" {
+		connectReq.Header.Set("Proxy-Authorization", authorization)
+	}
+	if d.connectReqHandler != nil {
+		d.connectReqHandler(connectReq)
+	}
+	c, err := d.dialProxy(network)
+	if err != nil {
+		return nil, nil, &UpstreamDialError{Proxy: d.u.Host, Err: err}
+	}
+	if err := connectReq.Write(c); err != nil {
+		c.Close()
+		return nil, nil, &UpstreamDialError{Proxy: d.u.Host, Err: err}
+	}
+	// Read response.
+	// Okay to use and discard buffered reader here, because
+	// TLS server will not speak until spoken to.
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		c.Close()
+		return nil, nil, &UpstreamDialError{Proxy: d.u.Host, Err: err}
+	}
+	return c, resp, nil
+}
+
+// dialSOCKS5 opens a tunnel to addr through a SOCKS5 proxy. Unless remote is
+// set, as for socks5h, host names are resolved by the proxy Resolver and the
+// destination is checked against the IPPolicy.
+func (d *upstreamDialer) dialSOCKS5(network, addr string, remote bool) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user, password, ok := d.credentials(); ok {
+		auth = &proxy.Auth{User: user, Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", d.u.Host, auth, dialerFunc(func(network, _ string) (net.Conn, error) {
+		c, err := d.dialProxy(network)
+		if err != nil {
+			return nil, &UpstreamDialError{Proxy: d.u.Host, Err: err}
+		}
+		return c, nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if !remote {
+		if addr, err = d.resolve(addr); err != nil {
+			return nil, err
+		}
+	}
+	c, err := dialer.Dial(network, addr)
+	if err != nil {
+		var dialErr *UpstreamDialError
+		if errors.As(err, &dialErr) {
+			return nil, dialErr
+		}
+		return nil, &TunnelRefusedError{Proxy: d.u.Host, Addr: addr, Reason: err.Error()}
+	}
+	return c, nil
+}
+
+// socks4Reasons are the SOCKS4 reply codes for a refused request.
+var socks4Reasons = map[byte]string{
+	91: "request rejected or failed",
+	92: "cannot connect to identd on the client",
+	93: "identd reported a different user",
+}
+
+// dialSOCKS4a opens a tunnel to addr through a SOCKS4a proxy, leaving host
+// names to the proxy. The username of the credentials is sent as user ID.
+func (d *upstreamDialer) dialSOCKS4a(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		// 0.0.0.x asks the proxy to resolve the host name appended below
+		req = append(req, 0, 0, 0, 1)
+	case ip.To4() != nil:
+		req = append(req, ip.To4()...)
+	default:
+		return nil, fmt.Errorf("socks4a cannot connect to IPv6 address %s", host)
+	}
+	user, _, _ := d.credentials()
+	req = append(append(req, user...), 0)
+	if ip == nil {
+		req = append(append(req, host...), 0)
+	}
+
+	c, err := d.dialProxy(network)
+	if err != nil {
+		return nil, &UpstreamDialError{Proxy: d.u.Host, Err: err}
+	}
+	var reply [8]byte
+	if _, err = c.Write(req); err == nil {
+		_, err = io.ReadFull(c, reply[:])
+	}
+	if err != nil {
+		c.Close()
+		return nil, &UpstreamDialError{Proxy: d.u.Host, Err: err}
+	}
+	if reply[1] != 90 {
+		c.Close()
+		reason, ok := socks4Reasons[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("unknown reply code %d", reply[1])
+		}
+		return nil, &TunnelRefusedError{Proxy: d.u.Host, Addr: addr, Reason: reason}
+	}
+	return c, nil
+}
+
+// resolve replaces the host of addr by the first of its addresses from the
+// proxy Resolver that the IPPolicy allows, the upstream proxy then connects
+// to that address.
+func (d *upstreamDialer) resolve(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	var resolver Resolver = net.DefaultResolver
+	if d.proxy.Resolver != nil {
+		resolver = d.proxy.Resolver
+	}
+	ctx := context.Background()
+	if timeout := d.proxy.Timeouts.Dial; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if d.proxy.IPPolicy != nil {
+		if addrs, err = d.proxy.IPPolicy.filter(host, addrs); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(addrs[0].String(), port), nil
+}
+
+// newUpstreamDialer returns the ConnectDial function for the upstream proxy
+// at u, or an error for an unsupported scheme.
+func (proxy *ProxyHttpServer) newUpstreamDialer(u *url.URL, connectReqHandler func(req *http.Request)) (func(network, addr string) (net.Conn, error), error) {
+	d := &upstreamDialer{proxy: proxy, u: u, connectReqHandler: connectReqHandler}
+	d.dialProxy = func(network string) (net.Conn, error) {
+		return proxy.dial(network, u.Host)
+	}
+	switch u.Scheme {
+	case "", "http":
+		u.Host = withDefaultPort(u.Host, "80")
+		return d.dialHTTP, nil
+	case "https", "wss":
+		u.Host = withDefaultPort(u.Host, "443")
+		config := defaultTLSConfig.Clone()
+		// the CONNECT request is HTTP/1.1
+		config.NextProtos = []string{"http/1.1"}
+		config.ServerName = stripPort(u.Host)
+		d.dialProxy = func(network string) (net.Conn, error) {
+			c, err := proxy.dial(network, u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(c, config), nil
+		}
+		return d.dialHTTP, nil
+	case "socks5", "socks5h":
+		u.Host = withDefaultPort(u.Host, "1080")
+		remote := u.Scheme == "socks5h"
+		return func(network, addr string) (net.Conn, error) {
+			return d.dialSOCKS5(network, addr, remote)
+		}, nil
+	case "socks4a":
+		u.Host = withDefaultPort(u.Host, "1080")
+		return d.dialSOCKS4a, nil
+	}
+	return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// challengeResponse returns the Proxy-Authorization answering the strongest
+// challenge of a 407 response to CONNECT addr, or "" if none is supported.
+func challengeResponse(h http.Header, addr, user, password string) string {
+	var basic bool
+	for _, challenge := range h["Proxy-Authenticate"] {
+		scheme, params := parseChallenge(challenge)
+		switch strings.ToLower(scheme) {
+		case "digest":
+			if auth := digestAuth(params, "CONNECT", addr, user, password); auth != "" {
+				return auth
+			}
+		case "basic":
+			basic = true
+		}
+	}
+	if basic {
+		return basicAuth(user, password)
+	}
+	return ""
+}
+
+// parseChallenge splits a WWW-Authenticate style challenge into its scheme
+// and its auth-params.
+func parseChallenge(challenge string) (string, map[string]string) {
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i < 0 {
+		return challenge, nil
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	params := make(map[string]string)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " \t,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				b.WriteByte(rest[j])
+			}
+			value, rest = b.String(), rest[j:]
+			if rest != "" {
+				// the closing quote
+				rest = rest[1:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// digestAuth answers a Digest challenge (RFC 7616) with qop auth, or the
+// RFC 2069 form when the challenge offers no qop. It returns "" for
+// algorithms and qops it does not support.
+func digestAuth(params map[string]string, method, uri, user, password string) string {
+	algorithm := params["algorithm"]
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return ""
+	}
+	h := func(s string) string {
+		hh := newHash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	var cnonceBytes [16]byte
+	rand.Read(cnonceBytes[:])
+	cnonce := hex.EncodeToString(cnonceBytes[:])
+	ha1 := h(user + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var qop string
+	if offered, ok := params["qop"]; ok {
+		for _, q := range strings.Split(offered, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return ""
+		}
+	}
+	const nc = "00000001"
+	var response string
+	if qop == "" {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q`, user, realm, nonce, uri, response)
+	if algorithm != "" {
+		auth += ", algorithm=" + algorithm
+	}
+	if qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce=%q`, qop, nc, cnonce)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		auth += fmt.Sprintf(`, opaque=%q`, opaque)
+	}
+	return auth
+}
@@ -0,0 +1,285 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeUpstream accepts connections on a local listener and hands each one to
+// serve.
+func fakeUpstream(t *testing.T, serve func(c net.Conn)) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// echoTunnel answers every line sent through a tunnel with "echo: " and the
+// line.
+func echoTunnel(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		io.WriteString(c, "echo: "+line)
+	}
+}
+
+func expectEcho(t *testing.T, c net.Conn) {
+	defer c.Close()
+	io.WriteString(c, "hello\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	orFatal("read through tunnel", err, t)
+	if line != "echo: hello\n" {
+		t.Errorf("unexpected tunnel answer %q", line)
+	}
+}
+
+func md5hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestConnectDialDigestAuth(t *testing.T) {
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	var target string
+	addr, done := fakeUpstream(t, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		target = req.Host
+		auth := req.Header.Get("Proxy-Authorization")
+		if auth == "" {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"proxy\"\r\n"+
+				"Proxy-Authenticate: Digest realm=\"proxy\", qop=\"auth,auth-int\", nonce=\""+nonce+"\", opaque=\"xyz\"\r\n"+
+				"Content-Length: 0\r\n\r\n")
+			return
+		}
+		scheme, p := parseChallenge(auth)
+		ha1 := md5hex("alice:proxy:secret")
+		ha2 := md5hex("CONNECT:" + req.Host)
+		expected := md5hex(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+		if scheme != "Digest" || p["response"] != expected || p["opaque"] != "xyz" || p["uri"] != req.Host {
+			io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+		echoTunnel(c)
+	})
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	proxy.UpstreamCredentials = func(u *url.URL) (string, string, bool) {
+		return "alice", "secret", u.Host == addr
+	}
+	c, err := proxy.NewConnectDialToProxy("http://"+addr)("tcp", "example.test:443")
+	orFatal("dial", err, t)
+	expectEcho(t, c)
+	if target != "example.test:443" {
+		t.Errorf("unexpected CONNECT target %q", target)
+	}
+}
+
+func TestConnectDialBasicAuthFromURL(t *testing.T) {
+	addr, done := fakeUpstream(t, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != basicAuth("bob", "p@ss") {
+			io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+		echoTunnel(c)
+	})
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	c, err := proxy.NewConnectDialToProxy("http://bob:p%40ss@"+addr)("tcp", "example.test:443")
+	orFatal("dial", err, t)
+	expectEcho(t, c)
+
+	_, err = proxy.NewConnectDialToProxy("http://bob:wrong@"+addr)("tcp", "example.test:443")
+	var refused *TunnelRefusedError
+	if !errors.As(err, &refused) || refused.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("expected the tunnel to be refused with 407, got %v", err)
+	}
+	if status := errorStatus(err, 500); status != http.StatusBadGateway {
+		t.Errorf("expected a refused tunnel to be reported as 502, got %d", status)
+	}
+}
+
+func TestConnectDialErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	orFatal("listen", err, t)
+	addr := l.Addr().String()
+	l.Close()
+
+	proxy := NewProxyHttpServer()
+	for _, scheme := range []string{"http", "socks5", "socks4a"} {
+		_, err := proxy.NewConnectDialToProxy(scheme+"://"+addr)("tcp", "10.0.0.1:443")
+		var dialErr *UpstreamDialError
+		if !errors.As(err, &dialErr) {
+			t.Errorf("expected an UpstreamDialError for unreachable %s proxy, got %v", scheme, err)
+		}
+	}
+	for _, u := range []string{"ftp://" + addr, "://" + addr} {
+		if dial := proxy.NewConnectDialToProxy(u); dial != nil {
+			t.Errorf("expected no dialer for %s, tunnels to be dialed directly", u)
+		}
+	}
+}
+
+func TestConnectDialSOCKS4a(t *testing.T) {
+	var target string
+	addr, done := fakeUpstream(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 4 || head[1] != 1 {
+			return
+		}
+		user, _ := r.ReadString(0)
+		host, _ := r.ReadString(0)
+		target = fmt.Sprintf("%s@%s:%d", strings.TrimSuffix(user, "\x00"), strings.TrimSuffix(host, "\x00"), binary.BigEndian.Uint16(head[2:]))
+		c.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+		echoTunnel(c)
+	})
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	c, err := proxy.NewConnectDialToProxy("socks4a://carol@"+addr)("tcp", "example.test:8443")
+	orFatal("dial", err, t)
+	expectEcho(t, c)
+	if target != "carol@example.test:8443" {
+		t.Errorf("unexpected SOCKS4a request %q", target)
+	}
+}
+
+func TestConnectDialSOCKS5(t *testing.T) {
+	targets := make(chan string, 2)
+	addr, done := fakeUpstream(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		// greeting, then username/password authentication
+		var greeting [2]byte
+		io.ReadFull(r, greeting[:])
+		io.ReadFull(r, make([]byte, greeting[1]))
+		c.Write([]byte{5, 2})
+		var head [2]byte
+		io.ReadFull(r, head[:])
+		user := make([]byte, head[1])
+		io.ReadFull(r, user)
+		plen, _ := r.ReadByte()
+		password := make([]byte, plen)
+		io.ReadFull(r, password)
+		if string(user) != "dave" || string(password) != "secret" {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+
+		var req [4]byte
+		io.ReadFull(r, req[:])
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(r, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n, _ := r.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(r, name)
+			host = string(name)
+		}
+		var port [2]byte
+		io.ReadFull(r, port[:])
+		targets <- fmt.Sprintf("%s:%d", host, binary.BigEndian.Uint16(port[:]))
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		echoTunnel(c)
+	})
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	resolver := NewDNSResolver(nil)
+	resolver.AddHost("example.test", net.ParseIP("10.9.8.7"))
+	proxy.Resolver = resolver
+	for scheme, expected := range map[string]string{
+		"socks5":  "10.9.8.7:443",
+		"socks5h": "example.test:443",
+	} {
+		c, err := proxy.NewConnectDialToProxy(scheme+"://dave:secret@"+addr)("tcp", "example.test:443")
+		orFatal("dial "+scheme, err, t)
+		expectEcho(t, c)
+		if target := <-targets; target != expected {
+			t.Errorf("expected %s to connect to %s, got %s", scheme, expected, target)
+		}
+	}
+}
+
+func TestConnectDialSOCKS5ChecksIPPolicy(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	addr, done := fakeUpstream(t, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		var greeting [2]byte
+		io.ReadFull(r, greeting[:])
+		io.ReadFull(r, make([]byte, greeting[1]))
+		c.Write([]byte{5, 0})
+		if _, err := r.ReadByte(); err == nil {
+			requests <- struct{}{}
+		}
+	})
+	defer done()
+
+	proxy := NewProxyHttpServer()
+	resolver := NewDNSResolver(nil)
+	resolver.AddHost("internal.test", net.ParseIP("10.9.8.7"))
+	proxy.Resolver = resolver
+	proxy.IPPolicy = DenyPrivateNetworks()
+	// the upstream proxy itself is on the loopback
+	orFatal("allow upstream", proxy.IPPolicy.AllowCIDR("127.0.0.1/32"), t)
+	for _, target := range []string{"internal.test:443", "10.9.8.7:443"} {
+		_, err := proxy.NewConnectDialToProxy("socks5://"+addr)("tcp", target)
+		var policyErr *IPPolicyError
+		if !errors.As(err, &policyErr) || !policyErr.IP.Equal(net.ParseIP("10.9.8.7")) {
+			t.Errorf("expected an IPPolicyError for %s, got %v", target, err)
+		}
+	}
+	select {
+	case <-requests:
+		t.Error("expected the upstream proxy not to be asked for the denied destination")
+	default:
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Digest realm="a \"quoted\" realm", nonce=abc, qop="auth,auth-int"`)
+	if scheme != "Digest" || params["realm"] != `a "quoted" realm` || params["nonce"] != "abc" || params["qop"] != "auth,auth-int" {
+		t.Errorf("unexpected challenge %s %v", scheme, params)
+	}
+}
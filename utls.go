@@ -13,21 +13,20 @@
 // The code here uses an idea adapted from meek_lite in obfs4proxy:
 // https://gitlab.com/yawning/obfs4/commit/4d453dab2120082b00bf6e63ab4aaeeda6b8d8a3
 // Instead of setting DialTLS on an http.Transport and exposing it directly, we
-// expose a wrapper type, UTLSRoundTripper, that contains within it either an
-// http.Transport or an http2.Transport. The first time a caller calls RoundTrip
-// on the wrapper, we initiate a uTLS connection (bootstrapConn), then peek at
-// the ALPN-negotiated protocol: if "h2", create an internal http2.Transport;
-// otherwise, create an internal http.Transport. In either case, set DialTLS on
-// the created Transport to a function that dials using uTLS. As a special case,
-// the first time the DialTLS callback is called, it reuses bootstrapConn (the
-// one made to peek at the ALPN), rather than make a new connection.
+// expose a wrapper type, UTLSRoundTripper, that contains within it both an
+// http.Transport and an http2.Transport, each with DialTLS set to a function
+// that dials using uTLS. The first time a request goes to an authority
+// (host:port), we initiate a uTLS connection (bootstrapConn), then peek at the
+// ALPN-negotiated protocol and remember it for that authority: requests to
+// authorities that negotiated "h2" go through the http2.Transport, all others
+// through the http.Transport. When the matching DialTLS callback is called for
+// that authority, it reuses bootstrapConn rather than make a new connection.
 //
-// Subsequent calls to RoundTripper on the wrapper just pass the requests though
-// the previously created http.Transport or http2.Transport. We assume that in
-// future RoundTrips, the ALPN-negotiated protocol will remain the same as it
-// was in the initial RoundTrip. At this point it is the http.Transport or
-// http2.Transport calling DialTLS, not us, so we can't dynamically swap the
-// underlying transport based on the ALPN.
+// A server may change its mind about ALPN later on. When a DialTLS callback
+// gets a connection speaking the other protocol, it records the new protocol
+// for the authority, parks the connection for the other transport and fails
+// the dial with errALPNSwitch; RoundTrip then retries the request once through
+// the other transport, which picks up the parked connection.
 //
 // https://bugs.torproject.org/29077
 // https://github.com/refraction-networking/utls/issues/16
@@ -37,12 +36,14 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
@@ -163,38 +164,118 @@ func dialUTLS(network, addr string, cfg *utls.Config, clientHelloID *utls.Client
 	if err != nil {
 		return nil, err
 	}
+	// dials may run concurrently, never modify the caller's config
+	if cfg == nil {
+		cfg = &utls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cache := sessionCacheFor(cfg); cache != nil {
+		cfg.ClientSessionCache = cache.ForHello(*clientHelloID)
+	}
 	cfg.MaxVersion = utls.VersionTLS13
-	uconn := utls.UClient(conn, cfg, *clientHelloID)
+	uconn, handshake := uClient(conn, cfg, *clientHelloID)
 	if cfg == nil || cfg.ServerName == "" {
 		serverName, _, err := net.SplitHostPort(addr)
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 		uconn.SetSNI(serverName)
 	}
-	err = uconn.Handshake()
+	err = handshake()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if cache := sessionCacheFor(cfg); cache != nil {
+		cache.recordHandshake(uconn.ConnectionState())
+	}
 	return uconn, nil
 }
 
+// dialFingerprints dials addr like dialUTLS with each of candidates in turn,
+// until a handshake succeeds and check, if not nil, accepts the connection.
+// selector, if not nil, learns the fingerprint that worked for addr and alpn.
+func dialFingerprints(network, addr string, cfg *utls.Config, candidates []utls.ClientHelloID, forward proxy.Dialer, selector *FingerprintSelector, alpn string, check func(*utls.UConn) error) (*utls.UConn, error) {
+	var lastErr error
+	for i := range candidates {
+		uconn, err := dialUTLS(network, addr, cfg, &candidates[i], forward)
+		if err == nil && check != nil {
+			if err = check(uconn); err != nil {
+				uconn.Close()
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if selector != nil {
+			selector.Learn(addr, alpn, candidates[i])
+		}
+		return uconn, nil
+	}
+	return nil, lastErr
+}
+
 // A http.RoundTripper that uses uTLS (with a specified Client Hello ID) to make
 // TLS connections.
 //
-// Can only be reused among servers which negotiate the same ALPN.
+// The protocol is chosen per authority, so one instance can be shared by any
+// number of servers and concurrent requests, for example to back every
+// ProxyCtx.RoundTripper of the proxy:
+//
+//	rt, _ := goproxy.NewUTLSRoundTripper("hellochrome_auto", &utls.Config{}, nil)
+//	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+//			return rt.RoundTrip(req)
+//		})
+//		return r, nil
+//	})
+//
+// Leave the Config's ServerName empty when sharing an instance between hosts,
+// otherwise every authority is dialed with that SNI.
 type UTLSRoundTripper struct {
-	sync.Mutex
-
 	clientHelloID *utls.ClientHelloID
 	config        *utls.Config
 	proxyDialer   proxy.Dialer
-	rt            http.RoundTripper
+	// if set, dials fall back to the fingerprints it offers for a host
+	fingerprints *FingerprintSelector
+
+	// Transports for https requests, chosen by the ALPN of each authority.
+	h1 *http.Transport
+	h2 *http2.Transport
+
+	lock        sync.Mutex
+	authorities map[string]*authority
+	// connections dialed for an authority but not handed to a transport
+	// yet, by authority and protocol
+	parked map[string]map[string]*utls.UConn
 
 	// Transport for HTTP requests, which don't use uTLS.
 	httpRT *http.Transport
 }
 
+// authority is the protocol negotiated with a host:port. ready is closed once
+// the bootstrap dial finished and protocol or err are set.
+type authority struct {
+	ready    chan struct{}
+	protocol string
+	err      error
+	// expires is set with protocol, the authority is bootstrapped again
+	// afterwards
+	expires time.Time
+}
+
+// authorityTTL is how long the protocol negotiated with an authority is
+// remembered, and maxAuthorities how many authorities are remembered at once.
+const (
+	authorityTTL   = 10 * time.Minute
+	maxAuthorities = 1024
+)
+
+var errALPNSwitch = errors.New("utls: server switched ALPN")
+
 func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	switch req.URL.Scheme {
 	case "http":
@@ -205,28 +286,174 @@ func (rt *UTLSRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 		return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
 	}
 
-	rt.Lock()
-	defer rt.Unlock()
+	addr, err := addrForDial(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	protocol, err := rt.protocolFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.transportFor(protocol).RoundTrip(req)
+	if errors.Is(err, errALPNSwitch) {
+		// The dial failed before anything was written, so the request
+		// can be sent again through the transport the server now wants.
+		if protocol, err = rt.protocolFor(addr); err != nil {
+			return nil, err
+		}
+		resp, err = rt.transportFor(protocol).RoundTrip(req)
+	}
+	return resp, err
+}
+
+func (rt *UTLSRoundTripper) transportFor(protocol string) http.RoundTripper {
+	if protocol == http2.NextProtoTLS {
+		return rt.h2
+	}
+	return rt.h1
+}
+
+// protocolFor returns the ALPN protocol negotiated with addr, dialing a
+// bootstrap connection on first use. Only requests to the same authority wait
+// for that dial.
+func (rt *UTLSRoundTripper) protocolFor(addr string) (string, error) {
+	now := time.Now()
+	rt.lock.Lock()
+	a, ok := rt.authorities[addr]
+	if ok && !a.expires.IsZero() && now.After(a.expires) {
+		ok = false
+	}
+	if !ok {
+		rt.evictLocked(now)
+		a = &authority{ready: make(chan struct{})}
+		rt.authorities[addr] = a
+	}
+	rt.lock.Unlock()
+
+	if !ok {
+		bootstrapConn, err := rt.dial("tcp", addr)
+		rt.lock.Lock()
+		if err != nil {
+			a.err = err
+			// let a later request try again
+			delete(rt.authorities, addr)
+		} else {
+			a.protocol = bootstrapConn.ConnectionState().NegotiatedProtocol
+			a.expires = time.Now().Add(authorityTTL)
+			rt.parkLocked(addr, bootstrapConn)
+		}
+		rt.lock.Unlock()
+		close(a.ready)
+	}
+	<-a.ready
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return a.protocol, a.err
+}
+
+// evictLocked makes room for a new authority once maxAuthorities are
+// remembered, dropping expired ones first. Authorities still bootstrapping
+// are kept.
+func (rt *UTLSRoundTripper) evictLocked(now time.Time) {
+	if len(rt.authorities) < maxAuthorities {
+		return
+	}
+	for _, expiredOnly := range []bool{true, false} {
+		for addr, a := range rt.authorities {
+			if len(rt.authorities) < maxAuthorities && !expiredOnly {
+				return
+			}
+			if a.expires.IsZero() || (expiredOnly && !now.After(a.expires)) {
+				continue
+			}
+			delete(rt.authorities, addr)
+			for _, uconn := range rt.parked[addr] {
+				uconn.Close()
+			}
+			delete(rt.parked, addr)
+		}
+	}
+}
+
+// parkLocked keeps uconn for the next dial of its protocol to addr. A
+// connection without ALPN is kept for the http/1.1 transport.
+func (rt *UTLSRoundTripper) parkLocked(addr string, uconn *utls.UConn) {
+	protocol := uconn.ConnectionState().NegotiatedProtocol
+	if protocol == "" {
+		protocol = "http/1.1"
+	}
+	if rt.parked[addr] == nil {
+		rt.parked[addr] = make(map[string]*utls.UConn)
+	}
+	if old := rt.parked[addr][protocol]; old != nil {
+		old.Close()
+	}
+	rt.parked[addr][protocol] = uconn
+}
 
-	if rt.rt == nil {
-		// On the first call, make an http.Transport or http2.Transport
-		// as appropriate.
-		var err error
-		rt.rt, err = makeRoundTripper(req.URL, rt.clientHelloID, rt.config, rt.proxyDialer)
+// dialTLS returns the DialTLS callback of the transport speaking protocol.
+func (rt *UTLSRoundTripper) dialTLS(protocol string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		rt.lock.Lock()
+		if uconn := rt.parked[addr][protocol]; uconn != nil {
+			delete(rt.parked[addr], protocol)
+			rt.lock.Unlock()
+			return uconn, nil
+		}
+		rt.lock.Unlock()
+
+		uconn, err := rt.dial(network, addr)
 		if err != nil {
 			return nil, err
 		}
+		if negotiated := uconn.ConnectionState().NegotiatedProtocol; negotiated != protocol &&
+			(negotiated == http2.NextProtoTLS || protocol == http2.NextProtoTLS) {
+			rt.lock.Lock()
+			if a, ok := rt.authorities[addr]; ok {
+				a.protocol = negotiated
+			}
+			rt.parkLocked(addr, uconn)
+			rt.lock.Unlock()
+			return nil, fmt.Errorf("%w: %q to %q for %s", errALPNSwitch, protocol, negotiated, addr)
+		}
+		return uconn, nil
 	}
-	// Forward the request to the internal http.Transport or http2.Transport.
-	return rt.rt.RoundTrip(req)
+}
+
+// dial makes a uTLS connection to addr with the fingerprint of rt.
+func (rt *UTLSRoundTripper) dial(network, addr string) (*utls.UConn, error) {
+	var alpn string
+	if rt.config != nil && len(rt.config.NextProtos) > 0 {
+		alpn = rt.config.NextProtos[0]
+	}
+	candidates := fingerprintCandidates(rt.fingerprints, addr, alpn, *rt.clientHelloID)
+	return dialFingerprints(network, addr, rt.config, candidates, rt.proxyDialer, rt.fingerprints, alpn, nil)
+}
+
+// CloseIdleConnections closes idle connections of both transports and any
+// connection dialed but not used yet.
+func (rt *UTLSRoundTripper) CloseIdleConnections() {
+	rt.lock.Lock()
+	parked := rt.parked
+	rt.parked = make(map[string]map[string]*utls.UConn)
+	rt.lock.Unlock()
+	for _, conns := range parked {
+		for _, uconn := range conns {
+			uconn.Close()
+		}
+	}
+	rt.h1.CloseIdleConnections()
+	rt.h2.CloseIdleConnections()
+	rt.httpRT.CloseIdleConnections()
 }
 
 // Unlike when using the native Go net/http (whose built-in proxy support we can
 // use by setting Proxy on an http.Transport), and unlike when using the browser
 // helper (the browser has its own proxy support), when using uTLS we have to
 // craft our own proxy connections.
-func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.ClientHelloID) (proxy.Dialer, error) {
-	var proxyDialer proxy.Dialer = proxy.Direct
+func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.ClientHelloID, forward proxy.Dialer) (proxy.Dialer, error) {
+	proxyDialer := forward
 	if proxyURL == nil {
 		return proxyDialer, nil
 	}
@@ -268,79 +495,6 @@ func makeProxyDialer(proxyURL *url.URL, cfg *utls.Config, clientHelloID *utls.Cl
 	return proxyDialer, err
 }
 
-func makeRoundTripper(url *url.URL, clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyDialer proxy.Dialer) (http.RoundTripper, error) {
-	addr, err := addrForDial(url)
-	if err != nil {
-		return nil, err
-	}
-
-	// Connect to the given address, through a proxy if requested, and
-	// initiate a TLS handshake using the given ClientHelloID. Return the
-	// resulting connection.
-	dial := func(network, addr string) (*utls.UConn, error) {
-		return dialUTLS(network, addr, cfg, clientHelloID, proxyDialer)
-	}
-
-	bootstrapConn, err := dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-
-	// Peek at what protocol we negotiated.
-	protocol := bootstrapConn.ConnectionState().NegotiatedProtocol
-
-	// Protects bootstrapConn.
-	var lock sync.Mutex
-	// This is the callback for future dials done by the internal
-	// http.Transport or http2.Transport.
-	dialTLS := func(network, addr string) (net.Conn, error) {
-		lock.Lock()
-		defer lock.Unlock()
-
-		// On the first dial, reuse bootstrapConn.
-		if bootstrapConn != nil {
-			uconn := bootstrapConn
-			bootstrapConn = nil
-			return uconn, nil
-		}
-
-		// Later dials make a new connection.
-		uconn, err := dial(network, addr)
-		if err != nil {
-			return nil, err
-		}
-		if uconn.ConnectionState().NegotiatedProtocol != protocol {
-			return nil, fmt.Errorf("unexpected switch from ALPN %q to %q",
-				protocol, uconn.ConnectionState().NegotiatedProtocol)
-		}
-
-		return uconn, nil
-	}
-
-	// Construct an http.Transport or http2.Transport depending on ALPN.
-	switch protocol {
-	case http2.NextProtoTLS:
-		// Unfortunately http2.Transport does not expose the same
-		// configuration options as http.Transport with regard to
-		// timeouts, etc., so we are at the mercy of the defaults.
-		// https://github.com/golang/go/issues/16581
-		return &http2.Transport{
-			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-				// Ignore the *tls.Config parameter; use our
-				// static cfg instead.
-				return dialTLS(network, addr)
-			},
-		}, nil
-	default:
-		// With http.Transport, copy important default fields from
-		// http.DefaultTransport, such as TLSHandshakeTimeout and
-		// IdleConnTimeout, before overriding DialTLS.
-		tr := httpRoundTripper.Clone()
-		tr.DialTLS = dialTLS
-		return tr, nil
-	}
-}
-
 func MakeHelloIDNoALPN() utls.ClientHelloID {
 	clientHelloID := utls.HelloRandomizedNoALPN
 	return PatchHelloID(clientHelloID)
@@ -399,8 +553,13 @@ func NewUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL) (http
 		// Special case for "none" and HelloGolang.
 		return httpRoundTripper, nil
 	}
+	return newUTLSRoundTripper(clientHelloID, cfg, proxyURL, nil)
+}
 
-	proxyDialer, err := makeProxyDialer(proxyURL, cfg, clientHelloID)
+// newUTLSRoundTripper is NewUTLSRoundTripper for clientHelloID. With a
+// selector, dials fall back to the fingerprints it offers for the host.
+func newUTLSRoundTripper(clientHelloID *utls.ClientHelloID, cfg *utls.Config, proxyURL *url.URL, selector *FingerprintSelector) (http.RoundTripper, error) {
+	proxyDialer, err := makeProxyDialer(proxyURL, cfg, clientHelloID, proxy.Direct)
 	if err != nil {
 		return nil, err
 	}
@@ -410,11 +569,31 @@ func NewUTLSRoundTripper(name string, cfg *utls.Config, proxyURL *url.URL) (http
 	httpRT := httpRoundTripper.Clone()
 	httpRT.Proxy = http.ProxyURL(proxyURL)
 
-	return &UTLSRoundTripper{
+	rt := &UTLSRoundTripper{
 		clientHelloID: clientHelloID,
 		config:        cfg,
 		proxyDialer:   proxyDialer,
-		// rt will be set in the first call to RoundTrip.
-		httpRT: httpRT,
-	}, nil
+		fingerprints:  selector,
+		authorities:   make(map[string]*authority),
+		parked:        make(map[string]map[string]*utls.UConn),
+		httpRT:        httpRT,
+	}
+	// With http.Transport, copy important default fields from
+	// http.DefaultTransport, such as TLSHandshakeTimeout and
+	// IdleConnTimeout, before overriding DialTLS.
+	rt.h1 = httpRoundTripper.Clone()
+	rt.h1.DialTLS = rt.dialTLS("http/1.1")
+	// Unfortunately http2.Transport does not expose the same
+	// configuration options as http.Transport with regard to
+	// timeouts, etc., so we are at the mercy of the defaults.
+	// https://github.com/golang/go/issues/16581
+	dialH2 := rt.dialTLS(http2.NextProtoTLS)
+	rt.h2 = &http2.Transport{
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			// Ignore the *tls.Config parameter; use our
+			// static cfg instead.
+			return dialH2(network, addr)
+		},
+	}
+	return rt, nil
 }
@@ -0,0 +1,82 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func newProtoServer(h2 bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = h2
+	srv.StartTLS()
+	return srv
+}
+
+func TestUTLSRoundTripperMultipleAuthorities(t *testing.T) {
+	h1 := newProtoServer(false)
+	defer h1.Close()
+	h2 := newProtoServer(true)
+	defer h2.Close()
+
+	rt, err := NewUTLSRoundTripper("hellochrome_auto", &utls.Config{InsecureSkipVerify: true}, nil)
+	orFatal("NewUTLSRoundTripper", err, t)
+	client := &http.Client{Transport: rt}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for srv, want := range map[*httptest.Server]string{h1: "HTTP/1.1", h2: "HTTP/2.0"} {
+			wg.Add(1)
+			go func(url, want string) {
+				defer wg.Done()
+				resp, err := client.Get(url)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer resp.Body.Close()
+				b, _ := ioutil.ReadAll(resp.Body)
+				if string(b) != want {
+					t.Errorf("%s: expected %s, got %s", url, want, b)
+				}
+			}(srv.URL, want)
+		}
+	}
+	wg.Wait()
+}
+
+func TestUTLSRoundTripperReusesNoALPNBootstrap(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rt, err := NewUTLSRoundTripper("hellorandomizednoalpn", &utls.Config{InsecureSkipVerify: true}, nil)
+	orFatal("NewUTLSRoundTripper", err, t)
+	client := &http.Client{Transport: rt}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		orFatal("get", err, t)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected the bootstrap connection to be reused, got %d connections", n)
+	}
+	if len(rt.(*UTLSRoundTripper).parked[srv.Listener.Addr().String()]) != 0 {
+		t.Error("bootstrap connection left parked")
+	}
+}
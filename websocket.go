@@ -1,14 +1,12 @@
 package goproxy
 
 import (
-	"bufio"
+	"errors"
 	"io"
-	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
+	"sync"
 
 	tls "github.com/refraction-networking/utls"
 )
@@ -34,9 +32,11 @@ func isWebSocketRequest(r *http.Request) bool {
 
 func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, clientConn *tls.Conn) {
 	targetURL := url.URL{Scheme: "wss", Host: req.URL.Host, Path: req.URL.Path}
+	wsReq := *req
+	wsReq.URL = &targetURL
 
 	// Connect to upstream
-	targetConn, err := tls.Dial("tcp", targetURL.Host, tlsConfig)
+	targetConn, err := proxy.dialUpgrade(ctx, &wsReq, tlsConfig)
 	if err != nil {
 		ctx.Warnf("Error dialing target site: %v", err)
 		return
@@ -44,135 +44,140 @@ func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWr
 	defer targetConn.Close()
 
 	// Perform handshake
-	if err := proxy.websocketHandshake(ctx, req, targetConn, clientConn); err != nil {
-		ctx.Warnf("Websocket handshake error: %v", err)
+	if err := req.Write(targetConn); err != nil {
+		ctx.Warnf("Error writing upgrade request: %v", err)
 		return
 	}
 
 	// Proxy wss connection
-	proxy.proxyWebsocket(ctx, targetConn, clientConn)
+	proxy.relayUpgrade(ctx, req, withIdleTimeout(clientConn, proxy.Timeouts.TunnelIdle), withIdleTimeout(targetConn, proxy.Timeouts.TunnelIdle))
 }
 
-func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request) {
-	h, ok := w.(http.Hijacker)
-	if !ok {
-		return
-	}
+// WebsocketMessage is a text or binary message of a websocket the proxy
+// relays, reassembled from its frames and decompressed.
+type WebsocketMessage struct {
+	// FromClient is set for messages the client sends to the server
+	FromClient bool
+	// Type is WebsocketText or WebsocketBinary
+	Type int
+	Data []byte
+
+	// compressed is set when the message was compressed, it is then
+	// compressed again when possible
+	compressed bool
+}
 
-	client, _, err := h.Hijack()
-	if err != nil {
-		log.Printf("Websocket error Hijack %s", err)
-		return
+// relayWebsocket relays the websocket between client and remote, whose
+// handshake negotiated the given compression, through the websocket
+// handlers. remoteReader reads from remote past the handshake response.
+func (proxy *ProxyHttpServer) relayWebsocket(ctx *ProxyCtx, client, remote io.ReadWriteCloser, remoteReader io.Reader, clientDeflate, serverDeflate *wsDeflate) {
+	r := &websocketRelay{
+		proxy:  proxy,
+		ctx:    ctx,
+		client: &wsEndpoint{w: client, r: ctx.shapeReader(client), sent: clientDeflate, received: serverDeflate},
+		server: &wsEndpoint{w: remote, r: ctx.shapeReader(remoteReader), sent: serverDeflate, received: clientDeflate, masked: true},
 	}
-
-	remote := dialRemote(req)
-	if remote == nil {
-		return
+	errc := make(chan error, 2)
+	go func() { errc <- r.pump(r.client, r.server) }()
+	go func() { errc <- r.pump(r.server, r.client) }()
+	if err := <-errc; err != nil {
+		ctx.Warnf("Websocket error: %v", err)
+		// unblock the other direction
+		client.Close()
+		remote.Close()
 	}
-	defer remote.Close()
-	defer client.Close()
-
-	log.Printf("Got websocket request %s %s", req.Host, req.URL)
-
-	req.Write(remote)
-	go func() {
-		for {
-			n, err := io.Copy(remote, client)
-			if err != nil {
-				log.Printf("Websocket error request %s", err)
-				return
-			}
-			if n == 0 {
-				log.Printf("Websocket nothing requested close")
-				return
-			}
-			time.Sleep(time.Millisecond) //reduce CPU usage due to infinite nonblocking loop
+	<-errc
+}
+
+// wsEndpoint is one side of an intercepted websocket.
+type wsEndpoint struct {
+	w     io.Writer
+	r     io.Reader
+	wlock sync.Mutex
+	// masked is set for the server, frames sent to it are masked
+	masked bool
+	// sent and received are the permessage-deflate state of the messages
+	// the endpoint sends and receives, nil without compression
+	sent, received *wsDeflate
+}
+
+func (e *wsEndpoint) write(f wsFrame) error {
+	e.wlock.Lock()
+	defer e.wlock.Unlock()
+	return writeWSFrame(e.w, f, e.masked)
+}
+
+// send writes msg to the endpoint as a single frame.
+func (e *wsEndpoint) send(msg *WebsocketMessage) error {
+	f := wsFrame{fin: true, opcode: msg.Type, payload: msg.Data}
+	if msg.compressed && e.received != nil && e.received.canCompress() {
+		payload, err := compressWS(msg.Data)
+		if err != nil {
+			return err
 		}
-	}()
+		f.payload, f.rsv1 = payload, true
+	}
+	return e.write(f)
+}
 
+// websocketRelay passes the messages of a websocket through the websocket
+// handlers of the proxy.
+type websocketRelay struct {
+	proxy          *ProxyHttpServer
+	ctx            *ProxyCtx
+	client, server *wsEndpoint
+}
+
+// pump relays what from sends to its peer, passing messages through the
+// handlers, until from closes the websocket or fails.
+func (r *websocketRelay) pump(from, to *wsEndpoint) error {
+	var msg *WebsocketMessage
 	for {
-		n, err := io.Copy(client, remote)
+		f, err := readWSFrame(from.r, maxWebsocketMessage)
 		if err != nil {
-			log.Printf("Websocket error response %s", err)
-			return
+			return err
 		}
-		if n == 0 {
-			log.Printf("Websocket nothing responded close")
-			return
+		if f.control() {
+			if err := to.write(f); err != nil {
+				return err
+			}
+			if f.opcode == WebsocketClose {
+				return nil
+			}
+			continue
 		}
-		time.Sleep(time.Millisecond) //reduce CPU usage due to infinite nonblocking loop
-	}
-}
 
-func dialRemote(req *http.Request) net.Conn {
-	port := ""
-	if !strings.Contains(req.URL.Host, ":") {
-		if req.URL.Scheme == "https" {
-			port = ":443"
+		if (f.opcode == wsContinuation) != (msg != nil) {
+			return errors.New("websocket frame out of sequence")
+		}
+		if msg == nil {
+			if f.rsv1 && from.sent == nil {
+				return errors.New("compressed websocket frame without permessage-deflate")
+			}
+			msg = &WebsocketMessage{FromClient: from == r.client, Type: f.opcode, Data: f.payload, compressed: f.rsv1}
 		} else {
-			port = ":80"
+			if len(msg.Data)+len(f.payload) > maxWebsocketMessage {
+				return errWebsocketTooBig
+			}
+			msg.Data = append(msg.Data, f.payload...)
 		}
-	}
-
-	if req.URL.Scheme == "https" {
-		conf := tls.Config{
-			//InsecureSkipVerify: true,
+		if !f.fin {
+			continue
 		}
-		remote, err := tls.Dial("tcp", req.URL.Host+port, &conf)
-		if err != nil {
-			log.Printf("Websocket error connect %s", err)
-			return nil
+		if msg.compressed {
+			if msg.Data, err = from.sent.decompress(msg.Data); err != nil {
+				return err
+			}
 		}
-		return remote
-	} else {
-		remote, err := net.Dial("tcp", req.URL.Host+port)
-		if err != nil {
-			log.Printf("Websocket error connect %s", err)
-			return nil
+		for _, m := range r.proxy.filterWebsocket(msg, r.ctx) {
+			dest := r.client
+			if m.FromClient {
+				dest = r.server
+			}
+			if err := dest.send(m); err != nil {
+				return err
+			}
 		}
-		return remote
-	}
-}
-
-func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) error {
-	// write handshake request to target
-	err := req.Write(targetSiteConn)
-	if err != nil {
-		ctx.Warnf("Error writing upgrade request: %v", err)
-		return err
+		msg = nil
 	}
-
-	targetTLSReader := bufio.NewReader(targetSiteConn)
-
-	// Read handshake response from target
-	resp, err := http.ReadResponse(targetTLSReader, req)
-	if err != nil {
-		ctx.Warnf("Error reading handhsake response  %v", err)
-		return err
-	}
-
-	// Run response through handlers
-	//resp = proxy.filterResponse(resp, ctx)
-
-	// Proxy handshake back to client
-	err = resp.Write(clientConn)
-	if err != nil {
-		ctx.Warnf("Error writing handshake response: %v", err)
-		return err
-	}
-	return nil
-}
-
-func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, dest io.ReadWriter, source io.ReadWriter) {
-	errChan := make(chan error, 2)
-	cp := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
-		ctx.Warnf("Websocket error: %v", err)
-		errChan <- err
-	}
-
-	// Start proxying websocket data
-	go cp(dest, source)
-	go cp(source, dest)
-	<-errChan
 }
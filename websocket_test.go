@@ -0,0 +1,245 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// websocketEcho completes websocket handshakes and answers every message
+// with "echo: " and the message. It pongs pings.
+var websocketEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-Websocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(accept[:])+"\r\n\r\n")
+	for {
+		f, err := readWSFrame(brw, maxWebsocketMessage)
+		if err != nil {
+			return
+		}
+		switch f.opcode {
+		case WebsocketPing:
+			writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketPong, payload: f.payload}, false)
+		case WebsocketClose:
+			writeWSFrame(conn, f, false)
+			return
+		default:
+			writeWSFrame(conn, wsFrame{fin: true, opcode: f.opcode, payload: append([]byte("echo: "), f.payload...)}, false)
+		}
+	}
+})
+
+func websocketEchoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(websocketEcho)
+}
+
+func writeWebsocketHandshake(t *testing.T, w io.Writer, target, host string) {
+	_, err := io.WriteString(w, "GET "+target+" HTTP/1.1\r\nHost: "+host+"\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	orFatal("write handshake", err, t)
+}
+
+// websocketThroughProxy opens the websocket at target through the proxy at
+// proxyAddr.
+func websocketThroughProxy(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	orFatal("dial proxy", err, t)
+	u, err := url.Parse(target)
+	orFatal("parse target", err, t)
+	writeWebsocketHandshake(t, conn, target, u.Host)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("read handshake response", err, t)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("unexpected handshake response %s", resp.Status)
+	}
+	return conn, r
+}
+
+func TestWebsocketMessageHandlers(t *testing.T) {
+	upstream := websocketEchoServer(t)
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnWebsocketMessage().DoFunc(func(msg *WebsocketMessage, ctx *ProxyCtx) []*WebsocketMessage {
+		switch {
+		case !msg.FromClient:
+			return []*WebsocketMessage{msg}
+		case string(msg.Data) == "drop":
+			return nil
+		case string(msg.Data) == "who":
+			return []*WebsocketMessage{{Type: WebsocketText, Data: []byte("the proxy")}}
+		}
+		msg.Data = []byte(strings.ToUpper(string(msg.Data)))
+		return []*WebsocketMessage{msg}
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, r := websocketThroughProxy(t, srv.Listener.Addr().String(), upstream.URL+"/chat")
+	defer conn.Close()
+
+	// a fragmented message with a ping in between
+	writeWSFrame(conn, wsFrame{opcode: WebsocketText, payload: []byte("hel")}, true)
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketPing, payload: []byte("p")}, true)
+	writeWSFrame(conn, wsFrame{fin: true, opcode: wsContinuation, payload: []byte("lo")}, true)
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketText, payload: []byte("drop")}, true)
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketText, payload: []byte("who")}, true)
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketClose}, true)
+
+	var got []string
+	for {
+		f, err := readWSFrame(r, maxWebsocketMessage)
+		orFatal("read frame", err, t)
+		if f.opcode == WebsocketClose {
+			break
+		}
+		got = append(got, string(f.payload))
+	}
+	// the injected answer races with the server's
+	sort.Strings(got)
+	if strings.Join(got, "|") != "echo: HELLO|p|the proxy" {
+		t.Errorf("unexpected messages %q", got)
+	}
+}
+
+func TestWebsocketThroughUpstreamProxy(t *testing.T) {
+	upstream := httptest.NewTLSServer(websocketEcho)
+	defer upstream.Close()
+
+	var connects int32
+	chained := NewProxyHttpServer()
+	chained.OnRequest().HandleConnectFunc(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		atomic.AddInt32(&connects, 1)
+		return OkConnect, host
+	})
+	chainedSrv := httptest.NewServer(chained)
+	defer chainedSrv.Close()
+	chainedURL, _ := url.Parse(chainedSrv.URL)
+
+	proxy := NewProxyHttpServer()
+	proxy.Tr.Proxy = http.ProxyURL(chainedURL)
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	proxy.WebsocketTLSConfig = &tls.Config{RootCAs: roots}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, r := websocketThroughProxy(t, srv.Listener.Addr().String(), upstream.URL+"/chat")
+	defer conn.Close()
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketText, payload: []byte("hello")}, true)
+	f, err := readWSFrame(r, maxWebsocketMessage)
+	orFatal("read frame", err, t)
+	if string(f.payload) != "echo: hello" {
+		t.Errorf("unexpected message %q", f.payload)
+	}
+	if atomic.LoadInt32(&connects) == 0 {
+		t.Error("expected the websocket to be tunneled through the upstream proxy")
+	}
+}
+
+// handshakeHandlers refuses websockets to /blocked, authorizes the others
+// and marks their handshake responses.
+func handshakeHandlers(proxy *ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.Path == "/blocked" {
+			return req, NewResponse(req, ContentTypeText, http.StatusForbidden, "no websockets here")
+		}
+		req.Header.Set("Authorization", "Bearer token")
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+			resp.Header.Set("X-Seen", "yes")
+		}
+		return resp
+	})
+}
+
+var authorizedWebsocketEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	websocketEcho(w, r)
+})
+
+func expectHandshakeHandled(t *testing.T, conn net.Conn, r *bufio.Reader, target, blocked, host string) {
+	writeWebsocketHandshake(t, conn, blocked, host)
+	resp, body := readBody(t, r)
+	if resp.StatusCode != http.StatusForbidden || body != "no websockets here" {
+		t.Fatalf("expected the handler to refuse the upgrade, got %s %q", resp.Status, body)
+	}
+
+	writeWebsocketHandshake(t, conn, target, host)
+	resp, err := http.ReadResponse(r, nil)
+	orFatal("read handshake response", err, t)
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("X-Seen") != "yes" {
+		t.Fatalf("expected the handled handshake response, got %s %v", resp.Status, resp.Header)
+	}
+	writeWSFrame(conn, wsFrame{fin: true, opcode: WebsocketText, payload: []byte("hello")}, true)
+	f, err := readWSFrame(r, maxWebsocketMessage)
+	orFatal("read frame", err, t)
+	if string(f.payload) != "echo: hello" {
+		t.Errorf("unexpected message %q", f.payload)
+	}
+}
+
+func TestWebsocketHandshakeHandlers(t *testing.T) {
+	upstream := httptest.NewServer(authorizedWebsocketEcho)
+	defer upstream.Close()
+
+	proxy := NewProxyHttpServer()
+	handshakeHandlers(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	host := upstream.Listener.Addr().String()
+	expectHandshakeHandled(t, conn, bufio.NewReader(conn), upstream.URL+"/chat", upstream.URL+"/blocked", host)
+}
+
+func TestMitmWebsocketHandshakeHandlers(t *testing.T) {
+	upstream := httptest.NewTLSServer(authorizedWebsocketEcho)
+	defer upstream.Close()
+	host := upstream.Listener.Addr().String()
+
+	proxy := NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(AlwaysMitm)
+	handshakeHandlers(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	orFatal("dial proxy", err, t)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	orFatal("write CONNECT", err, t)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	orFatal("read CONNECT response", err, t)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT refused: %s", resp.Status)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	expectHandshakeHandled(t, tlsConn, bufio.NewReader(tlsConn), "/chat", "/blocked", host)
+}
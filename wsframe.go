@@ -0,0 +1,266 @@
+package goproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Websocket opcodes, see RFC 6455 section 5.2. Messages are WebsocketText or
+// WebsocketBinary, the others are control frames.
+const (
+	WebsocketText   = 0x1
+	WebsocketBinary = 0x2
+	WebsocketClose  = 0x8
+	WebsocketPing   = 0x9
+	WebsocketPong   = 0xA
+
+	wsContinuation = 0x0
+)
+
+// maxWebsocketMessage bounds the size of the messages the proxy reassembles,
+// after decompression.
+const maxWebsocketMessage = 32 << 20
+
+var errWebsocketTooBig = errors.New("websocket message too big")
+
+// wsFrame is a single websocket frame, with its payload unmasked.
+type wsFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  int
+	payload []byte
+}
+
+func (f *wsFrame) control() bool {
+	return f.opcode&0x8 != 0
+}
+
+// readWSFrame reads a frame from r, refusing payloads larger than limit.
+func readWSFrame(r io.Reader, limit int64) (wsFrame, error) {
+	var f wsFrame
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return f, err
+	}
+	f.fin = head[0]&0x80 != 0
+	f.rsv1 = head[0]&0x40 != 0
+	f.opcode = int(head[0] & 0x0f)
+	if head[0]&0x30 != 0 {
+		return f, errors.New("websocket frame with unknown extension bits")
+	}
+	switch f.opcode {
+	case wsContinuation, WebsocketText, WebsocketBinary, WebsocketClose, WebsocketPing, WebsocketPong:
+	default:
+		return f, fmt.Errorf("websocket frame with unknown opcode %#x", f.opcode)
+	}
+
+	n := int64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		if ext[0]&0x80 != 0 {
+			return f, errWebsocketTooBig
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if f.control() && (!f.fin || f.rsv1 || n > 125) {
+		return f, errors.New("invalid websocket control frame")
+	}
+	if n > limit {
+		return f, errWebsocketTooBig
+	}
+
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return f, err
+		}
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	if masked {
+		maskWS(mask, f.payload)
+	}
+	return f, nil
+}
+
+// writeWSFrame writes f to w, masked with a random key if masked is set, as
+// frames sent to servers must be.
+func writeWSFrame(w io.Writer, f wsFrame, masked bool) error {
+	b := make([]byte, 0, 14+len(f.payload))
+	first := byte(f.opcode)
+	if f.fin {
+		first |= 0x80
+	}
+	if f.rsv1 {
+		first |= 0x40
+	}
+	b = append(b, first)
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(f.payload); {
+	case n <= 125:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, maskBit|127)
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(n))
+	}
+
+	if !masked {
+		_, err := w.Write(append(b, f.payload...))
+		return err
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	b = append(b, mask[:]...)
+	start := len(b)
+	b = append(b, f.payload...)
+	maskWS(mask, b[start:])
+	_, err := w.Write(b)
+	return err
+}
+
+func maskWS(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i&3]
+	}
+}
+
+// wsDeflate is the permessage-deflate state of the messages one side of a
+// websocket sends, see RFC 7692.
+type wsDeflate struct {
+	// noContextTakeover is set when the sender compresses every message
+	// on its own
+	noContextTakeover bool
+	// maxWindowBits is the LZ77 window of the sender, which its peer
+	// decompresses with
+	maxWindowBits int
+	// window holds the end of what was decompressed so far, which the next
+	// message may refer to
+	window []byte
+}
+
+// parseWSDeflate returns the permessage-deflate state of each side as
+// negotiated by the handshake response header h, nil when the extension
+// is not in use. ok is false if h negotiated extensions the proxy does not
+// understand.
+func parseWSDeflate(h http.Header) (client, server *wsDeflate, ok bool) {
+	for _, value := range h["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(value, ",") {
+			params := strings.Split(ext, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" || client != nil {
+				return nil, nil, false
+			}
+			client = &wsDeflate{maxWindowBits: 15}
+			server = &wsDeflate{maxWindowBits: 15}
+			for _, param := range params[1:] {
+				name, value := strings.TrimSpace(param), ""
+				if i := strings.IndexByte(name, '='); i >= 0 {
+					name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+				}
+				bits, _ := strconv.Atoi(value)
+				switch name {
+				case "client_no_context_takeover":
+					client.noContextTakeover = true
+				case "server_no_context_takeover":
+					server.noContextTakeover = true
+				case "client_max_window_bits":
+					if bits != 0 {
+						client.maxWindowBits = bits
+					}
+				case "server_max_window_bits":
+					server.maxWindowBits = bits
+				default:
+					return nil, nil, false
+				}
+			}
+		}
+	}
+	return client, server, true
+}
+
+// wsDeflateTail terminates a compressed message, the empty stored block the
+// sender stripped and a final empty block.
+const wsDeflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// decompress inflates a compressed message.
+func (d *wsDeflate) decompress(payload []byte) ([]byte, error) {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(payload), strings.NewReader(wsDeflateTail)), d.window)
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxWebsocketMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxWebsocketMessage {
+		return nil, errWebsocketTooBig
+	}
+	if !d.noContextTakeover {
+		window := append(d.window, data...)
+		if len(window) > 1<<15 {
+			window = append([]byte(nil), window[len(window)-1<<15:]...)
+		}
+		d.window = window
+	}
+	return data, nil
+}
+
+// canCompress reports whether messages can be compressed for the peer of
+// the sender d describes. Messages are compressed on their own with a full
+// window, which peers restricting the window cannot inflate.
+func (d *wsDeflate) canCompress() bool {
+	return d.maxWindowBits >= 15
+}
+
+var wsFlateWriters sync.Pool
+
+// compressWS deflates a message on its own.
+func compressWS(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := wsFlateWriters.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer wsFlateWriters.Put(w)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte(wsDeflateTail[:4])), nil
+}
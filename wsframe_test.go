@@ -0,0 +1,74 @@
+package goproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"net/http"
+	"testing"
+)
+
+func TestWSFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte{'x'}, size)
+		for _, masked := range []bool{false, true} {
+			var buf bytes.Buffer
+			orFatal("write", writeWSFrame(&buf, wsFrame{fin: true, rsv1: true, opcode: WebsocketBinary, payload: payload}, masked), t)
+			if masked && bytes.Contains(buf.Bytes(), payload) && size > 4 {
+				t.Errorf("expected a masked payload of %d bytes", size)
+			}
+			f, err := readWSFrame(&buf, maxWebsocketMessage)
+			orFatal("read", err, t)
+			if !f.fin || !f.rsv1 || f.opcode != WebsocketBinary || !bytes.Equal(f.payload, payload) {
+				t.Errorf("frame of %d bytes, masked %v, did not survive: %+v", size, masked, f)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	writeWSFrame(&buf, wsFrame{fin: true, opcode: WebsocketText, payload: make([]byte, 100)}, false)
+	if _, err := readWSFrame(&buf, 99); err != errWebsocketTooBig {
+		t.Errorf("expected the frame to be refused as too big, got %v", err)
+	}
+	buf.Reset()
+	writeWSFrame(&buf, wsFrame{opcode: WebsocketPing}, false)
+	if _, err := readWSFrame(&buf, maxWebsocketMessage); err == nil {
+		t.Error("expected a fragmented control frame to be refused")
+	}
+}
+
+func TestWSDeflateContextTakeover(t *testing.T) {
+	client, server, ok := parseWSDeflate(http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_no_context_takeover; server_max_window_bits=10"}})
+	if !ok || !client.noContextTakeover || server.noContextTakeover || server.canCompress() || !client.canCompress() {
+		t.Fatalf("unexpected parameters %+v %+v", client, server)
+	}
+	if _, _, ok := parseWSDeflate(http.Header{"Sec-Websocket-Extensions": {"x-webkit-deflate-frame"}}); ok {
+		t.Error("expected unknown extensions to be reported")
+	}
+
+	// the second message refers to the first one
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	var messages [][]byte
+	for _, text := range []string{"hello websocket world", "hello websocket world, again"} {
+		buf.Reset()
+		w.Write([]byte(text))
+		w.Flush()
+		messages = append(messages, bytes.TrimSuffix(append([]byte(nil), buf.Bytes()...), []byte{0, 0, 0xff, 0xff}))
+	}
+	d := &wsDeflate{maxWindowBits: 15}
+	for i, expected := range []string{"hello websocket world", "hello websocket world, again"} {
+		data, err := d.decompress(messages[i])
+		orFatal("decompress", err, t)
+		if string(data) != expected {
+			t.Errorf("expected %q, got %q", expected, data)
+		}
+	}
+
+	compressed, err := compressWS([]byte("fresh context"))
+	orFatal("compress", err, t)
+	data, err := d.decompress(compressed)
+	orFatal("decompress own", err, t)
+	if string(data) != "fresh context" {
+		t.Errorf("unexpected round trip %q", data)
+	}
+}